@@ -6,11 +6,16 @@ package adb
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
-	"os/exec"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Device struct {
@@ -26,16 +31,12 @@ type Device struct {
 var deviceRegex = regexp.MustCompile(`^([^\s]+)\s+device(.*)$`)
 
 func Devices() ([]*Device, error) {
-	cmd := exec.Command("adb", "devices", "-l")
-	stdout, err := cmd.StdoutPipe()
+	list, err := hostRequest("host:devices-l")
 	if err != nil {
 		return nil, err
 	}
-	if err := cmd.Start(); err != nil {
-		return nil, err
-	}
 	var devices []*Device
-	scanner := bufio.NewScanner(stdout)
+	scanner := bufio.NewScanner(strings.NewReader(list))
 	for scanner.Scan() {
 		m := deviceRegex.FindStringSubmatch(scanner.Text())
 		if m == nil {
@@ -80,31 +81,34 @@ func Devices() ([]*Device, error) {
 	return devices, nil
 }
 
-func (d *Device) AdbCmd(args ...string) *exec.Cmd {
-	cmdArgs := append([]string{"-s", d.ID}, args...)
-	return exec.Command("adb", cmdArgs...)
+// AdbShell runs a command on the device, returning a stream with its
+// output. Note that standard output and error are not separated.
+func (d *Device) AdbShell(args ...string) (io.ReadCloser, error) {
+	return d.openService("shell:" + shellJoin(args))
 }
 
-func (d *Device) AdbShell(args ...string) *exec.Cmd {
-	shellArgs := append([]string{"shell"}, args...)
-	return d.AdbCmd(shellArgs...)
+// shellOutput runs a command on the device and returns all of its output.
+func (d *Device) shellOutput(args ...string) ([]byte, error) {
+	stdout, err := d.AdbShell(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer stdout.Close()
+	return io.ReadAll(stdout)
 }
 
 var propLineRegex = regexp.MustCompile(`^\[(.*)\]: \[(.*)\]$`)
 
 func (d *Device) AdbProps() (map[string]string, error) {
-	cmd := d.AdbShell("getprop")
-	stdout, err := cmd.StdoutPipe()
+	stdout, err := d.AdbShell("getprop")
 	if err != nil {
 		return nil, err
 	}
-	if err := cmd.Start(); err != nil {
-		return nil, err
-	}
+	defer stdout.Close()
 	props := make(map[string]string)
 	scanner := bufio.NewScanner(stdout)
 	for scanner.Scan() {
-		m := propLineRegex.FindStringSubmatch(scanner.Text())
+		m := propLineRegex.FindStringSubmatch(strings.TrimRight(scanner.Text(), "\r"))
 		if m == nil {
 			continue
 		}
@@ -115,8 +119,7 @@ func (d *Device) AdbProps() (map[string]string, error) {
 }
 
 func (d *Device) AdbProp(property string) (string, error) {
-	cmd := d.AdbShell("getprop", property)
-	stdout, err := cmd.Output()
+	stdout, err := d.shellOutput("getprop", property)
 	if err != nil {
 		return "", err
 	}
@@ -142,7 +145,11 @@ func AdbPropFallback(device *Device, props map[string]string, property string) (
 }
 
 func getFailureCode(r *regexp.Regexp, line string) string {
-	return r.FindStringSubmatch(line)[1]
+	m := r.FindStringSubmatch(line)
+	if m == nil {
+		return line
+	}
+	return m[1]
 }
 
 func getAbis(device *Device, props map[string]string) []string {
@@ -165,37 +172,103 @@ func getAbis(device *Device, props map[string]string) []string {
 var installFailureRegex = regexp.MustCompile(`^Failure \[INSTALL_(.+)\]$`)
 
 func (d *Device) Install(path string) error {
-	cmd := d.AdbCmd(append([]string{"install", "-r"}, path)...)
-	output, err := cmd.CombinedOutput()
-	line := getResultLine(output)
-	if err == nil && line == "Success" {
-		return nil
-	}
-	errMsg := parseError(getFailureCode(installFailureRegex, line))
-	if err != nil {
-		return fmt.Errorf("%v: %v", err, errMsg)
-	}
-	return errMsg
+	return d.InstallProgress(path, "", nil)
 }
 
 func (d *Device) InstallUser(path, user string) error {
-	cmd := d.AdbCmd(append([]string{"install", "-r", "--user"}, user, path)...)
-	output, err := cmd.CombinedOutput()
+	return d.InstallProgress(path, user, nil)
+}
+
+// remoteTmpDir is where APKs are pushed to before installing them.
+const remoteTmpDir = "/data/local/tmp"
+
+// streamedInstallLevel is the first API level whose package manager can read
+// an APK from standard input, via "cmd package install -S".
+const streamedInstallLevel = 24
+
+// InstallProgress installs the APK at path, writing the bytes sent to the
+// device to progress if it's not nil. If user is empty, the app is installed
+// for all users.
+//
+// The APK is streamed to the package manager if the device supports it.
+// Otherwise, it is first pushed to a temporary directory via the sync
+// protocol.
+func (d *Device) InstallProgress(apkPath, user string, progress io.Writer) error {
+	f, err := os.Open(apkPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	var r io.Reader = f
+	if progress != nil {
+		r = io.TeeReader(f, progress)
+	}
+	var output []byte
+	if d.APILevel >= streamedInstallLevel {
+		output, err = d.streamInstall(r, info.Size(), user)
+		var serr *ServerError
+		if errors.As(err, &serr) {
+			// Older adbd versions lack the exec service.
+			output, err = d.pushInstall(r, filepath.Base(apkPath), user)
+		}
+	} else {
+		output, err = d.pushInstall(r, filepath.Base(apkPath), user)
+	}
+	if err != nil {
+		return err
+	}
 	line := getResultLine(output)
-	if err == nil && line == "Success" {
+	if line == "Success" {
 		return nil
 	}
-	errMsg := parseError(getFailureCode(installFailureRegex, line))
+	return parseError(getFailureCode(installFailureRegex, line))
+}
+
+func pmInstallArgs(user string) []string {
+	args := []string{"install", "-r"}
+	if user != "" {
+		args = append(args, "--user", user)
+	}
+	return args
+}
+
+// streamInstall sends the APK to the package manager's standard input. The
+// exec service is used instead of shell, as the latter may mangle binary
+// data.
+func (d *Device) streamInstall(r io.Reader, size int64, user string) ([]byte, error) {
+	args := append([]string{"cmd", "package"}, pmInstallArgs(user)...)
+	args = append(args, "-S", strconv.FormatInt(size, 10))
+	c, err := d.openService("exec:" + shellJoin(args))
 	if err != nil {
-		return fmt.Errorf("%v: %v", err, errMsg)
+		return nil, err
+	}
+	defer c.Close()
+	if _, err := io.CopyN(c, r, size); err != nil {
+		return nil, fmt.Errorf("could not stream APK: %v", err)
+	}
+	return io.ReadAll(c)
+}
+
+// pushInstall pushes the APK to the device and then installs it with the
+// package manager, like older versions of "adb install" do.
+func (d *Device) pushInstall(r io.Reader, name, user string) ([]byte, error) {
+	remote := path.Join(remoteTmpDir, name)
+	if err := d.push(r, remote, uint32(time.Now().Unix())); err != nil {
+		return nil, fmt.Errorf("could not push %s: %v", name, err)
 	}
-	return errMsg
+	defer d.shellOutput("rm", "-f", remote)
+	args := append([]string{"pm"}, pmInstallArgs(user)...)
+	return d.shellOutput(append(args, remote)...)
 }
 
 func getResultLine(output []byte) string {
 	scanner := bufio.NewScanner(bytes.NewReader(output))
 	for scanner.Scan() {
-		l := scanner.Text()
+		l := strings.TrimRight(scanner.Text(), "\r")
 		if strings.HasPrefix(l, "Success") {
 			return l
 		}
@@ -210,31 +283,27 @@ func getResultLine(output []byte) string {
 var deleteFailureRegex = regexp.MustCompile(`^Failure \[DELETE_(.+)\]$`)
 
 func (d *Device) Uninstall(pkg string) error {
-	cmd := d.AdbCmd("uninstall", pkg)
-	output, err := cmd.CombinedOutput()
-	line := getResultLine(output)
-	if err == nil && line == "Success" {
-		return nil
-	}
-	errMsg := parseError(getFailureCode(deleteFailureRegex, line))
-	if err != nil {
-		return fmt.Errorf("%v: %v", err, errMsg)
-	}
-	return errMsg
+	return d.uninstall(pkg, "")
 }
 
 func (d *Device) UninstallUser(pkg, user string) error {
-	cmd := d.AdbCmd("uninstall", "--user", user, pkg)
-	output, err := cmd.CombinedOutput()
-	line := getResultLine(output)
-	if err == nil && line == "Success" {
-		return nil
+	return d.uninstall(pkg, user)
+}
+
+func (d *Device) uninstall(pkg, user string) error {
+	args := []string{"pm", "uninstall"}
+	if user != "" {
+		args = append(args, "--user", user)
 	}
-	errMsg := parseError(getFailureCode(deleteFailureRegex, line))
+	output, err := d.shellOutput(append(args, pkg)...)
 	if err != nil {
-		return fmt.Errorf("%v: %v", err, errMsg)
+		return err
 	}
-	return errMsg
+	line := getResultLine(output)
+	if line == "Success" {
+		return nil
+	}
+	return parseError(getFailureCode(deleteFailureRegex, line))
 }
 
 type Package struct {
@@ -256,20 +325,17 @@ var (
 )
 
 func (d *Device) Installed() (map[string]Package, error) {
-	cmd := d.AdbShell("dumpsys", "package", "packages")
-	stdout, err := cmd.StdoutPipe()
+	stdout, err := d.AdbShell("dumpsys", "package", "packages")
 	if err != nil {
 		return nil, err
 	}
-	if err := cmd.Start(); err != nil {
-		return nil, err
-	}
+	defer stdout.Close()
 	packages := make(map[string]Package)
 	scanner := bufio.NewScanner(stdout)
 	var cur Package
 	first := true
 	for scanner.Scan() {
-		l := scanner.Text()
+		l := strings.TrimRight(scanner.Text(), "\r")
 		if m := packageRegex.FindStringSubmatch(l); m != nil {
 			if first {
 				first = false
@@ -314,14 +380,11 @@ func (d *Device) Installed() (map[string]Package, error) {
 var currentUserIdRegex = regexp.MustCompile(`^ *mUserLru: \[.*\b(\d+)\b\]`)
 
 func (d *Device) CurrentUserId() (int, error) {
-	cmd := d.AdbShell("dumpsys", "activity")
-	stdout, err := cmd.StdoutPipe()
+	stdout, err := d.AdbShell("dumpsys", "activity")
 	if err != nil {
 		return -1, err
 	}
-	if err := cmd.Start(); err != nil {
-		return -1, err
-	}
+	defer stdout.Close()
 	scanner := bufio.NewScanner(stdout)
 	for scanner.Scan() {
 		m := currentUserIdRegex.FindStringSubmatch(scanner.Text())
@@ -346,3 +409,24 @@ func AllUserIds(installed map[string]Package) map[int]struct{} {
 	}
 	return uidMap
 }
+
+// PackagePaths returns the paths of the APKs of an installed package, with
+// the base APK first.
+func (d *Device) PackagePaths(pkg string) ([]string, error) {
+	output, err := d.shellOutput("pm", "path", pkg)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasPrefix(line, "package:") {
+			paths = append(paths, strings.TrimPrefix(line, "package:"))
+		}
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("could not find the APK of %s", pkg)
+	}
+	return paths, nil
+}
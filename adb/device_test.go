@@ -0,0 +1,254 @@
+// Copyright (c) 2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package adb
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testProps = "[ro.build.version.sdk]: [30]\r\n[ro.product.cpu.abilist]: [x86_64,arm64-v8a]\r\n"
+
+func testServer(t *testing.T) (*fakeServer, *fakeDevice) {
+	dev := &fakeDevice{shell: map[string]string{
+		"getprop": testProps,
+	}}
+	s := &fakeServer{
+		devicesList: "emulator-5554          device product:sdk_phone model:Pixel_3 device:generic transport_id:1\n" +
+			"0123456789ABCDEF       unauthorized usb:1-1 transport_id:2\n",
+		devices: map[string]*fakeDevice{"emulator-5554": dev},
+	}
+	s.start(t)
+	return s, dev
+}
+
+func TestDevices(t *testing.T) {
+	testServer(t)
+	devices, err := Devices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Device{{
+		ID:       "emulator-5554",
+		Product:  "sdk_phone",
+		Model:    "Pixel_3",
+		Device:   "generic",
+		ABIs:     []string{"x86_64", "arm64-v8a"},
+		APILevel: 30,
+	}}
+	if !reflect.DeepEqual(devices, want) {
+		t.Fatalf("Unexpected devices.\nGot:  %+v\nWant: %+v", devices[0], want[0])
+	}
+}
+
+func TestServerError(t *testing.T) {
+	testServer(t)
+	d := &Device{ID: "missing"}
+	_, err := d.AdbProp("ro.build.version.sdk")
+	var serr *ServerError
+	if !errors.As(err, &serr) {
+		t.Fatalf("want a *ServerError, got %v", err)
+	}
+	if serr.Message != "device 'missing' not found" {
+		t.Fatalf("unexpected message: %q", serr.Message)
+	}
+}
+
+func TestInstalled(t *testing.T) {
+	_, dev := testServer(t)
+	dev.shell["dumpsys package packages"] = `Packages:
+  Package [foo.bar] (1234abc):
+    userId=10100
+    versionCode=12 minSdk=21 targetSdk=30
+    versionName=1.2
+    pkgFlags=[ HAS_CODE ALLOW_CLEAR_USER_DATA ]
+    User 0: ceDataInode=1 installed=true hidden=false
+    User 10: ceDataInode=2 installed=false hidden=false
+  Package [com.android.system] (5678def):
+    versionCode=30 minSdk=30 targetSdk=30
+    versionName=11
+    pkgFlags=[ SYSTEM HAS_CODE ]
+    User 0: ceDataInode=3 installed=true hidden=false
+`
+	d := &Device{ID: "emulator-5554"}
+	got, err := d.Installed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Package{
+		"foo.bar": {
+			ID:                   "foo.bar",
+			VersCode:             12,
+			VersName:             "1.2",
+			InstalledForUsers:    []int{0},
+			NotInstalledForUsers: []int{10},
+		},
+		"com.android.system": {
+			ID:                   "com.android.system",
+			VersCode:             30,
+			VersName:             "11",
+			IsSystem:             true,
+			InstalledForUsers:    []int{0},
+			NotInstalledForUsers: []int{},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Unexpected packages.\nGot:  %+v\nWant: %+v", got, want)
+	}
+}
+
+func TestInstall(t *testing.T) {
+	_, dev := testServer(t)
+	dev.shell["pm install -r /data/local/tmp/foo.apk"] = "Success\r\n"
+	dev.shell["pm install -r --user 10 /data/local/tmp/foo.apk"] = "Failure [INSTALL_FAILED_VERSION_DOWNGRADE]\n"
+
+	apk := filepath.Join(t.TempDir(), "foo.apk")
+	if err := os.WriteFile(apk, []byte("apk contents"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d := &Device{ID: "emulator-5554"}
+	if err := d.Install(apk); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(dev.files["/data/local/tmp/foo.apk"]); got != "apk contents" {
+		t.Fatalf("unexpected pushed contents: %q", got)
+	}
+	if err := d.InstallUser(apk, "10"); err != ErrVersionDowngrade {
+		t.Fatalf("want ErrVersionDowngrade, got %v", err)
+	}
+	want := []string{
+		"pm install -r /data/local/tmp/foo.apk",
+		"rm -f /data/local/tmp/foo.apk",
+		"pm install -r --user 10 /data/local/tmp/foo.apk",
+		"rm -f /data/local/tmp/foo.apk",
+	}
+	if got := dev.commands(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Unexpected commands.\nGot:  %q\nWant: %q", got, want)
+	}
+}
+
+func TestInstallStreamed(t *testing.T) {
+	_, dev := testServer(t)
+	dev.shell["cmd package install -r -S 12"] = "Success\n"
+	dev.shell["cmd package install -r --user 10 -S 12"] = "Failure [INSTALL_FAILED_INSUFFICIENT_STORAGE]\n"
+
+	apk := filepath.Join(t.TempDir(), "foo.apk")
+	if err := os.WriteFile(apk, []byte("apk contents"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d := &Device{ID: "emulator-5554", APILevel: 30}
+	var progress bytes.Buffer
+	if err := d.InstallProgress(apk, "", &progress); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(dev.files["stdin"]); got != "apk contents" {
+		t.Fatalf("unexpected streamed contents: %q", got)
+	}
+	if got := progress.String(); got != "apk contents" {
+		t.Fatalf("unexpected progress: %q", got)
+	}
+	if err := d.InstallUser(apk, "10"); err != ErrInsufficientStorage {
+		t.Fatalf("want ErrInsufficientStorage, got %v", err)
+	}
+	if len(dev.files) != 1 {
+		t.Fatalf("streamed installs should not push files: %v", dev.files)
+	}
+}
+
+func TestUninstall(t *testing.T) {
+	_, dev := testServer(t)
+	dev.shell["pm uninstall foo.bar"] = "Success\n"
+	dev.shell["pm uninstall --user 0 foo.bar"] = "Failure [DELETE_FAILED_INTERNAL_ERROR]\n"
+
+	d := &Device{ID: "emulator-5554"}
+	if err := d.Uninstall("foo.bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.UninstallUser("foo.bar", "0"); err != ErrInternalError {
+		t.Fatalf("want ErrInternalError, got %v", err)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for _, c := range []struct {
+		in, want string
+	}{
+		{"dumpsys", "dumpsys"},
+		{"/data/local/tmp/foo_1.apk", "/data/local/tmp/foo_1.apk"},
+		{"", "''"},
+		{"two words", "'two words'"},
+		{"it's", `'it'\''s'`},
+	} {
+		if got := shellQuote(c.in); got != c.want {
+			t.Errorf("shellQuote(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestRemoteFile(t *testing.T) {
+	_, dev := testServer(t)
+	dev.shell["pm path foo.bar"] = "package:/data/app/foo.bar-1/base.apk\r\npackage:/data/app/foo.bar-1/split_config.en.apk\r\n"
+	dev.files = map[string][]byte{"/data/app/foo.bar-1/base.apk": []byte("0123456789")}
+
+	d := &Device{ID: "emulator-5554"}
+	paths, err := d.PackagePaths("foo.bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paths[0] != "/data/app/foo.bar-1/base.apk" || len(paths) != 2 {
+		t.Fatalf("unexpected paths: %q", paths)
+	}
+	f, err := d.OpenFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Size() != 10 {
+		t.Fatalf("want size 10, got %d", f.Size())
+	}
+	buf := make([]byte, 4)
+	if n, err := f.ReadAt(buf, 3); err != nil || string(buf[:n]) != "3456" {
+		t.Fatalf("ReadAt(3) = %q, %v", buf[:n], err)
+	}
+	if n, err := f.ReadAt(buf, 8); err != io.EOF || string(buf[:n]) != "89" {
+		t.Fatalf("ReadAt(8) = %q, %v", buf[:n], err)
+	}
+	if _, err := d.OpenFile("/missing"); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+}
+
+func TestRemoteFileApk(t *testing.T) {
+	_, dev := testServer(t)
+	data, err := os.ReadFile(filepath.Join("..", "testdata", "staticrepo", "org.vi_server.red_screen_2.apk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev.files = map[string][]byte{"/data/app/base.apk": data}
+
+	// An APK is read from its end, where the central directory and the
+	// signing block are, as done to find out who signed an installed app.
+	f, err := (&Device{ID: "emulator-5554"}).OpenFile("/data/app/base.apk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(f, f.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, zf := range zr.File {
+		if zf.Name == "AndroidManifest.xml" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("AndroidManifest.xml not found in the remote APK")
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright (c) 2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package adb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ServerError is returned when the ADB server rejects a request, such as
+// when a device is not found or a service is not supported.
+type ServerError struct {
+	Request string
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("adb server refused %q: %s", e.Request, e.Message)
+}
+
+// serverAddr returns the address of the ADB server, honoring the same
+// environment variables as the adb tool.
+func serverAddr() string {
+	if sock := os.Getenv("ADB_SERVER_SOCKET"); strings.HasPrefix(sock, "tcp:") {
+		addr := strings.TrimPrefix(sock, "tcp:")
+		if !strings.Contains(addr, ":") {
+			addr = net.JoinHostPort(host, addr)
+		}
+		return addr
+	}
+	p := strconv.Itoa(port)
+	if env := os.Getenv("ANDROID_ADB_SERVER_PORT"); env != "" {
+		p = env
+	}
+	return net.JoinHostPort(host, p)
+}
+
+// conn is a connection to the ADB server, speaking its "smart socket"
+// protocol. Requests are length-prefixed strings, and the server answers
+// each with OKAY, or with FAIL followed by a length-prefixed message.
+type conn struct {
+	net.Conn
+}
+
+func dial() (*conn, error) {
+	c, err := net.Dial("tcp", serverAddr())
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to the adb server: %v", err)
+	}
+	return &conn{c}, nil
+}
+
+func (c *conn) request(req string) error {
+	if _, err := fmt.Fprintf(c, "%04x%s", len(req), req); err != nil {
+		return err
+	}
+	status := make([]byte, 4)
+	if _, err := io.ReadFull(c, status); err != nil {
+		return fmt.Errorf("could not read adb server response to %q: %v", req, err)
+	}
+	switch string(status) {
+	case "OKAY":
+		return nil
+	case "FAIL":
+		msg, err := c.readString()
+		if err != nil {
+			return err
+		}
+		return &ServerError{Request: req, Message: msg}
+	}
+	return fmt.Errorf("unexpected adb server response to %q: %q", req, status)
+}
+
+// readString reads a string prefixed by its length in four hex digits.
+func (c *conn) readString() (string, error) {
+	hexLen := make([]byte, 4)
+	if _, err := io.ReadFull(c, hexLen); err != nil {
+		return "", err
+	}
+	n, err := strconv.ParseUint(string(hexLen), 16, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid adb message length %q", hexLen)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// hostRequest sends a request to the ADB server itself, such as
+// "host:devices-l", and returns its response.
+func hostRequest(req string) (string, error) {
+	c, err := dial()
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	if err := c.request(req); err != nil {
+		return "", err
+	}
+	return c.readString()
+}
+
+// openService connects to a service on the device, such as "shell:ls". The
+// returned connection carries the service's raw stream.
+func (d *Device) openService(service string) (*conn, error) {
+	c, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.request("host:transport:" + d.ID); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := c.request(service); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// shellQuote quotes an argument for the device's shell if needed.
+func shellQuote(arg string) string {
+	if arg != "" && strings.IndexFunc(arg, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' ||
+			r >= '0' && r <= '9' || strings.ContainsRune("-_./:=,+@%", r))
+	}) < 0 {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// shellJoin quotes and joins a command's arguments.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+const (
+	syncMaxChunk = 64 * 1024
+	// syncFileMode is a regular file with 0644 permissions.
+	syncFileMode = 0o100644
+)
+
+// syncRequest writes a sync protocol request: a four-byte ID followed by a
+// little-endian length and that many bytes of data.
+func (c *conn) syncRequest(id string, data []byte) error {
+	buf := make([]byte, 8, 8+len(data))
+	copy(buf, id)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(data)))
+	_, err := c.Write(append(buf, data...))
+	return err
+}
+
+// syncStatus reads the server's answer to a completed sync transfer.
+func (c *conn) syncStatus() error {
+	hdr := make([]byte, 8)
+	if _, err := io.ReadFull(c, hdr); err != nil {
+		return err
+	}
+	n := binary.LittleEndian.Uint32(hdr[4:])
+	switch string(hdr[:4]) {
+	case "OKAY":
+		return nil
+	case "FAIL":
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(c, msg); err != nil {
+			return err
+		}
+		return &ServerError{Request: "sync:", Message: string(msg)}
+	}
+	return fmt.Errorf("unexpected sync response %q", hdr[:4])
+}
+
+// push copies the contents of r to the remote path on the device, using
+// the sync protocol. The mtime is given in seconds since the epoch.
+func (d *Device) push(r io.Reader, remote string, mtime uint32) error {
+	c, err := d.openService("sync:")
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.syncRequest("SEND", []byte(fmt.Sprintf("%s,%d", remote, syncFileMode))); err != nil {
+		return err
+	}
+	buf := make([]byte, syncMaxChunk)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := c.syncRequest("DATA", buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	done := make([]byte, 8)
+	copy(done, "DONE")
+	binary.LittleEndian.PutUint32(done[4:], mtime)
+	if _, err := c.Write(done); err != nil {
+		return err
+	}
+	if err := c.syncStatus(); err != nil {
+		return err
+	}
+	return c.syncRequest("QUIT", nil)
+}
+
+// RemoteFile is a file on the device which can be read at any offset, so
+// that only the needed parts of large files are transferred.
+type RemoteFile struct {
+	d    *Device
+	path string
+	size int64
+}
+
+// OpenFile opens a file on the device for reading.
+func (d *Device) OpenFile(path string) (*RemoteFile, error) {
+	c, err := d.openService("exec:" + shellJoin([]string{"stat", "-c", "%s", path}))
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	output, err := io.ReadAll(c)
+	if err != nil {
+		return nil, err
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("could not stat %s: %s", path, bytes.TrimSpace(output))
+	}
+	return &RemoteFile{d: d, path: path, size: size}, nil
+}
+
+func (f *RemoteFile) Size() int64 { return f.size }
+
+func (f *RemoteFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	// tail counts bytes from one.
+	c, err := f.d.openService("exec:" + shellJoin([]string{"tail", "-c", "+" + strconv.FormatInt(off+1, 10), f.path}))
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	n, err := io.ReadFull(c, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
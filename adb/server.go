@@ -4,7 +4,6 @@
 package adb
 
 import (
-	"fmt"
 	"net"
 	"os/exec"
 )
@@ -15,7 +14,7 @@ const (
 )
 
 func IsServerRunning() bool {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
+	conn, err := net.Dial("tcp", serverAddr())
 	if err != nil {
 		return false
 	}
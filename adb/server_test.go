@@ -0,0 +1,206 @@
+// Copyright (c) 2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package adb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeServer implements enough of the ADB server's protocol to test the
+// client without a real server nor devices.
+type fakeServer struct {
+	// devicesList is the response to host:devices-l.
+	devicesList string
+	devices     map[string]*fakeDevice
+}
+
+type fakeDevice struct {
+	// shell maps commands to their output.
+	shell map[string]string
+
+	mu sync.Mutex
+	// ran lists the shell commands that were run, in order.
+	ran []string
+	// files holds the files pushed via the sync protocol. The data read
+	// by a streamed install is kept as "stdin".
+	files map[string][]byte
+}
+
+var tailRegex = regexp.MustCompile(`^tail -c \+(\d+) (.+)$`)
+
+func (d *fakeDevice) commands() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.ran...)
+}
+
+// start listens on a random port, and points the client at it for the
+// duration of the test.
+func (s *fakeServer) start(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(c)
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	t.Setenv("ADB_SERVER_SOCKET", "")
+	t.Setenv("ANDROID_ADB_SERVER_PORT", port)
+}
+
+func readRequest(c net.Conn) (string, error) {
+	hexLen := make([]byte, 4)
+	if _, err := io.ReadFull(c, hexLen); err != nil {
+		return "", err
+	}
+	n, err := strconv.ParseUint(string(hexLen), 16, 16)
+	if err != nil {
+		return "", err
+	}
+	req := make([]byte, n)
+	_, err = io.ReadFull(c, req)
+	return string(req), err
+}
+
+func fail(c net.Conn, msg string) {
+	fmt.Fprintf(c, "FAIL%04x%s", len(msg), msg)
+}
+
+func (s *fakeServer) handle(c net.Conn) {
+	defer c.Close()
+	req, err := readRequest(c)
+	if err != nil {
+		return
+	}
+	switch {
+	case req == "host:devices-l":
+		fmt.Fprintf(c, "OKAY%04x%s", len(s.devicesList), s.devicesList)
+	case strings.HasPrefix(req, "host:transport:"):
+		serial := strings.TrimPrefix(req, "host:transport:")
+		dev, ok := s.devices[serial]
+		if !ok {
+			fail(c, fmt.Sprintf("device '%s' not found", serial))
+			return
+		}
+		io.WriteString(c, "OKAY")
+		dev.handle(c)
+	default:
+		fail(c, "unknown host service")
+	}
+}
+
+func (d *fakeDevice) handle(c net.Conn) {
+	req, err := readRequest(c)
+	if err != nil {
+		return
+	}
+	switch {
+	case strings.HasPrefix(req, "shell:"):
+		cmd := strings.TrimPrefix(req, "shell:")
+		d.mu.Lock()
+		d.ran = append(d.ran, cmd)
+		d.mu.Unlock()
+		io.WriteString(c, "OKAY")
+		io.WriteString(c, d.shell[cmd])
+	case strings.HasPrefix(req, "exec:"):
+		cmd := strings.TrimPrefix(req, "exec:")
+		d.mu.Lock()
+		d.ran = append(d.ran, cmd)
+		d.mu.Unlock()
+		io.WriteString(c, "OKAY")
+		// Streamed installs read the APK from stdin first.
+		if fields := strings.Fields(cmd); len(fields) > 1 && fields[len(fields)-2] == "-S" {
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			data := make([]byte, size)
+			if _, err := io.ReadFull(c, data); err != nil {
+				return
+			}
+			d.mu.Lock()
+			if d.files == nil {
+				d.files = make(map[string][]byte)
+			}
+			d.files["stdin"] = data
+			d.mu.Unlock()
+		}
+		if m := tailRegex.FindStringSubmatch(cmd); m != nil {
+			off, _ := strconv.Atoi(m[1])
+			d.mu.Lock()
+			data := d.files[m[2]]
+			d.mu.Unlock()
+			if off-1 < len(data) {
+				c.Write(data[off-1:])
+			}
+			return
+		}
+		if strings.HasPrefix(cmd, "stat -c %s ") {
+			path := strings.TrimPrefix(cmd, "stat -c %s ")
+			d.mu.Lock()
+			data, ok := d.files[path]
+			d.mu.Unlock()
+			if !ok {
+				fmt.Fprintf(c, "stat: '%s': No such file or directory\n", path)
+				return
+			}
+			fmt.Fprintf(c, "%d\n", len(data))
+			return
+		}
+		io.WriteString(c, d.shell[cmd])
+	case req == "sync:":
+		io.WriteString(c, "OKAY")
+		d.handleSync(c)
+	default:
+		fail(c, "unknown service")
+	}
+}
+
+func (d *fakeDevice) handleSync(c net.Conn) {
+	var remote string
+	var data []byte
+	for {
+		hdr := make([]byte, 8)
+		if _, err := io.ReadFull(c, hdr); err != nil {
+			return
+		}
+		id, n := string(hdr[:4]), binary.LittleEndian.Uint32(hdr[4:])
+		if id == "DONE" {
+			d.mu.Lock()
+			if d.files == nil {
+				d.files = make(map[string][]byte)
+			}
+			d.files[remote] = data
+			d.mu.Unlock()
+			io.WriteString(c, "OKAY\x00\x00\x00\x00")
+			continue
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(c, payload); err != nil {
+			return
+		}
+		switch id {
+		case "SEND":
+			remote, _, _ = strings.Cut(string(payload), ",")
+			data = nil
+		case "DATA":
+			data = append(data, payload...)
+		case "QUIT":
+			return
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic writes a file by calling write on a temporary file in the
+// same directory, which is then synced and renamed into place. An interrupted
+// or failed write thus leaves either the old file or the new one, never a
+// truncated mix of the two.
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	err = write(f)
+	if err == nil {
+		err = f.Chmod(0o644)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = renameSynced(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// writeFileBytes is like os.WriteFile, but atomic.
+func writeFileBytes(path string, b []byte) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
+
+// renameSynced renames a file that was already synced, and then syncs the
+// directory so that the rename itself is durable too. Not all systems support
+// syncing directories, so errors in doing so are ignored.
+func renameSynced(oldpath, newpath string) error {
+	if err := os.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(newpath)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// repoAuth holds the credentials for a repository. Basic auth is used if a
+// username is set, and a bearer token otherwise. If neither is set, they are
+// looked up in the netrc file, if any.
+type repoAuth struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// PasswordEnv names an environment variable holding the password.
+	PasswordEnv string `json:"passwordEnv,omitempty"`
+
+	Token string `json:"token,omitempty"`
+	// TokenEnv names an environment variable holding the token.
+	TokenEnv string `json:"tokenEnv,omitempty"`
+
+	// Netrc is the path to a netrc-style file, where the credentials are
+	// found by host name.
+	Netrc string `json:"netrc,omitempty"`
+}
+
+// baseTransport is what authTransport sends requests with.
+var baseTransport http.RoundTripper = httpTransport
+
+// authTransport adds the credentials and headers of the repository a request
+// is for, if any. Since it works on each request separately, including those
+// following a redirect, they are never sent to other hosts.
+type authTransport struct{}
+
+func (authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := repoForURL(req.URL)
+	if r == nil || (r.Auth == nil && len(r.Headers) == 0) {
+		return baseTransport.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	for name, value := range r.Headers {
+		req.Header.Set(name, value)
+	}
+	if r.Auth != nil {
+		if err := r.Auth.apply(req); err != nil {
+			return nil, &authError{repo: r.ID, err: err}
+		}
+	}
+	return baseTransport.RoundTrip(req)
+}
+
+// authError is returned when a repo's credentials can't be loaded. Unlike
+// network errors, retrying won't help.
+type authError struct {
+	repo string
+	err  error
+}
+
+func (e *authError) Error() string {
+	return fmt.Sprintf("credentials for repo %s: %v", e.repo, e.err)
+}
+
+// repoForURL returns the enabled repo that u belongs to, being under its URL
+// or any of the mirrors in its config. The mirrors listed by an index are not
+// considered, as they are run by third parties.
+func repoForURL(u *url.URL) *repo {
+	for i := range config.Repos {
+		r := &config.Repos[i]
+		for _, base := range append([]string{r.URL}, r.Mirrors...) {
+			if b, err := url.Parse(base); err == nil && underURL(u, b) {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+func underURL(u, base *url.URL) bool {
+	if u.Scheme != base.Scheme || !strings.EqualFold(u.Host, base.Host) {
+		return false
+	}
+	prefix := strings.TrimSuffix(base.Path, "/") + "/"
+	return u.Path == strings.TrimSuffix(base.Path, "/") || strings.HasPrefix(u.Path, prefix)
+}
+
+func (a *repoAuth) apply(req *http.Request) error {
+	username, password := a.Username, a.Password
+	if a.PasswordEnv != "" {
+		var ok bool
+		if password, ok = os.LookupEnv(a.PasswordEnv); !ok {
+			return fmt.Errorf("%s is not set", a.PasswordEnv)
+		}
+	}
+	token := a.Token
+	if a.TokenEnv != "" {
+		var ok bool
+		if token, ok = os.LookupEnv(a.TokenEnv); !ok {
+			return fmt.Errorf("%s is not set", a.TokenEnv)
+		}
+	}
+	if username == "" && token == "" && a.Netrc != "" {
+		var err error
+		username, password, err = netrcLogin(a.Netrc, req.URL.Hostname())
+		if err != nil {
+			return err
+		}
+	}
+	switch {
+	case username != "":
+		req.SetBasicAuth(username, password)
+	case token != "":
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
+// netrcLogin finds the login and password for a host in a netrc-style file,
+// falling back to its default entry. A leading "~/" in the path stands for the
+// home directory.
+func netrcLogin(path, host string) (login, password string, err error) {
+	if rest := strings.TrimPrefix(path, "~/"); rest != path {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", err
+		}
+		path = filepath.Join(home, rest)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	var fields []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields = append(fields, strings.Fields(line)...)
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+	type entry struct{ login, password string }
+	var match, def *entry
+	var cur *entry
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "machine", "default":
+			cur = &entry{}
+			if fields[i] == "default" {
+				def = cur
+			} else if i+1 < len(fields) {
+				i++
+				if fields[i] == host && match == nil {
+					match = cur
+				}
+			}
+		case "login", "password":
+			if cur != nil && i+1 < len(fields) {
+				if fields[i] == "login" {
+					cur.login = fields[i+1]
+				} else {
+					cur.password = fields[i+1]
+				}
+				i++
+			}
+		}
+	}
+	if match == nil {
+		match = def
+	}
+	if match == nil {
+		return "", "", fmt.Errorf("no credentials for %s in %s", host, path)
+	}
+	return match.login, match.password, nil
+}
@@ -24,6 +24,7 @@ Usage:
 	$ fdroidcl clean index
 	$ fdroidcl clean cache
 `[1:],
+	Mutates: true,
 }
 
 func init() {
@@ -71,6 +72,14 @@ func cleanIndex() error {
 	if err != nil {
 		return err
 	}
+	err = removeGlob(mustData() + "/*-index-v2.json")
+	if err != nil {
+		return err
+	}
+	err = removeGlob(mustData() + "/*-index-v2.json-etag")
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -0,0 +1,686 @@
+// Copyright (c) 2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var cmdConfig = &Command{
+	UsageLine: "config",
+	Short:     "Get or set config options",
+	Long: `
+Show or change the options in the config file. Changes are checked before
+being saved, so that the config is always valid.
+
+Show the whole config, or a single option. Repo passwords and tokens are
+not shown:
+
+	$ fdroidcl config
+	$ fdroidcl config get <KEY>
+
+Change options:
+
+	$ fdroidcl config set <KEY> <VALUE>
+	$ fdroidcl config unset <KEY>
+	$ fdroidcl config edit
+
+A key is made of the option names in the config file, separated by dots.
+Repositories are selected by their ID, and the rest of a key after a map
+option such as "headers" or "pinnedRepos" is the name of the entry. Values
+are taken as text for text options, and as JSON otherwise. For example:
+
+	$ fdroidcl config set retries 5
+	$ fdroidcl config set repos.f-droid.mirrors '["https://mirror.example.org/repo"]'
+	$ fdroidcl config set pinnedRepos.org.example.app upstream
+
+The edit subcommand opens a copy of the config in $VISUAL or $EDITOR, and
+saves it if it's valid once the editor exits.
+`[1:],
+	Mutates: true,
+}
+
+func init() {
+	cmdConfig.Run = runConfig
+	cmdConfig.ReadOnly = func(args []string) bool {
+		return len(args) == 0 || args[0] == "get"
+	}
+}
+
+func runConfig(args []string) error {
+	if len(args) == 0 {
+		c := redactedConfig()
+		return printJSON(&c)
+	}
+	if args[0] == "get" {
+		if len(args) != 2 {
+			return fmt.Errorf("wrong amount of arguments")
+		}
+		return getConfig(args[1])
+	} else if args[0] == "set" {
+		if len(args) != 3 {
+			return fmt.Errorf("wrong amount of arguments")
+		}
+		return setConfig(args[1], &args[2])
+	} else if args[0] == "unset" {
+		if len(args) != 2 {
+			return fmt.Errorf("wrong amount of arguments")
+		}
+		return setConfig(args[1], nil)
+	} else if args[0] == "edit" {
+		if len(args) != 1 {
+			return fmt.Errorf("wrong amount of arguments")
+		}
+		return editConfig()
+	} else {
+		return fmt.Errorf("wrong usage")
+	}
+}
+
+// configVersion is the current layout version of the config file.
+const configVersion = 2
+
+// configMigrations holds the functions which migrate a decoded config from
+// each version to the next one, starting at version 1.
+var configMigrations = []func(raw map[string]interface{}){
+	// Version 1 had no version key. Fingerprints could be written in any
+	// case and with separators, and URLs could end with a slash. The
+	// f-droid.org repos were not pinned to the official key either.
+	func(raw map[string]interface{}) {
+		repos, _ := raw["repos"].([]interface{})
+		for _, r := range repos {
+			r, ok := r.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if s, ok := r["fingerprint"].(string); ok {
+				r["fingerprint"] = normalizeFingerprint(s)
+			}
+			if s, ok := r["url"].(string); ok {
+				r["url"] = strings.TrimRight(s, "/")
+			}
+			if fp, _ := r["fingerprint"].(string); fp == "" && isOfficialRepo(r["url"]) {
+				r["fingerprint"] = fdroidFingerprint
+			}
+			mirrors, _ := r["mirrors"].([]interface{})
+			for i, m := range mirrors {
+				if s, ok := m.(string); ok {
+					mirrors[i] = strings.TrimRight(s, "/")
+				}
+			}
+		}
+	},
+}
+
+// isOfficialRepo reports whether url is one of the f-droid.org repos signed
+// with fdroidFingerprint.
+func isOfficialRepo(url interface{}) bool {
+	return url == "https://f-droid.org/repo" || url == "https://f-droid.org/archive"
+}
+
+func readConfig() error {
+	b, err := os.ReadFile(configPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	c, err := parseConfig(b)
+	if err != nil {
+		return err
+	}
+	config = *c
+	return nil
+}
+
+func writeConfig(c *userConfig) error {
+	c.Version = configVersion
+	b, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return fmt.Errorf("cannot encode config: %v", err)
+	}
+	if err := writeFileBytes(configPath(), b); err != nil {
+		return fmt.Errorf("cannot write config file: %v", err)
+	}
+	return nil
+}
+
+// parseConfig decodes a config file, migrating it from older versions. Unlike
+// json.Unmarshal, it fails on unknown keys and on values of the wrong type,
+// and the errors start with the key at fault.
+func parseConfig(b []byte) (*userConfig, error) {
+	raw, err := decodeRawConfig(b)
+	if err != nil {
+		return nil, err
+	}
+	version := 1
+	if v, ok := raw["version"]; ok {
+		n, _ := v.(json.Number)
+		i, err := strconv.Atoi(string(n))
+		if err != nil || i < 1 {
+			return nil, fmt.Errorf("version: must be a positive integer")
+		}
+		version = i
+	}
+	if version > configVersion {
+		return nil, fmt.Errorf("version: %d is newer than the latest supported, %d; try a newer fdroidcl", version, configVersion)
+	}
+	for ; version < configVersion; version++ {
+		configMigrations[version-1](raw)
+	}
+	raw["version"] = json.Number(strconv.Itoa(configVersion))
+	return checkConfig(raw)
+}
+
+func decodeRawConfig(b []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var raw map[string]interface{}
+	if err := dec.Decode(&raw); err != nil {
+		var serr *json.SyntaxError
+		if errors.As(err, &serr) && serr.Offset <= int64(len(b)) {
+			before := b[:serr.Offset]
+			line := bytes.Count(before, []byte("\n")) + 1
+			col := len(before) - bytes.LastIndexByte(before, '\n')
+			return nil, fmt.Errorf("line %d, column %d: %v", line, col, err)
+		}
+		return nil, err
+	}
+	if raw == nil {
+		return nil, fmt.Errorf("the config must be a JSON object")
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after the config object")
+	}
+	return raw, nil
+}
+
+// checkConfig turns a decoded config into a userConfig, checking it fully.
+func checkConfig(raw map[string]interface{}) (*userConfig, error) {
+	if err := checkConfigValue(raw, reflect.TypeOf(userConfig{}), ""); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var c userConfig
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// jsonFields maps the JSON names of a struct type's fields to their types.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" || f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// jsonRequired reports whether a struct type's field with the given JSON
+// name is always encoded, as it has no omitempty option.
+func jsonRequired(t reflect.Type, name string) bool {
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("json"), ",")
+		if tag[0] == name {
+			return !contains(tag[1:], "omitempty")
+		}
+	}
+	return false
+}
+
+func joinKey(key, name string) string {
+	if key == "" {
+		return name
+	}
+	return key + "." + name
+}
+
+// repoKey is the key of a repo in errors, by its ID if it has a usable one.
+func repoKey(key string, i int, id string) string {
+	if id == "" || strings.Contains(id, ".") {
+		return fmt.Sprintf("%s[%d]", key, i)
+	}
+	return key + "." + id
+}
+
+// checkConfigValue checks that a decoded JSON value could be decoded into the
+// type t without any loss.
+func checkConfigValue(v interface{}, t reflect.Type, key string) error {
+	if v == nil {
+		return nil
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: must be an object", key)
+		}
+		names := make([]string, 0, len(m))
+		for name := range m {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var fields map[string]reflect.Type
+		if t.Kind() == reflect.Struct {
+			fields = jsonFields(t)
+		}
+		for _, name := range names {
+			var ft reflect.Type
+			if fields == nil {
+				ft = t.Elem()
+			} else if ft = fields[name]; ft == nil {
+				return fmt.Errorf("%s: unknown key", joinKey(key, name))
+			}
+			if err := checkConfigValue(m[name], ft, joinKey(key, name)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		list, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: must be a list", key)
+		}
+		for i, elem := range list {
+			elemKey := fmt.Sprintf("%s[%d]", key, i)
+			if m, ok := elem.(map[string]interface{}); ok {
+				id, _ := m["id"].(string)
+				elemKey = repoKey(key, i, id)
+			}
+			if err := checkConfigValue(elem, t.Elem(), elemKey); err != nil {
+				return err
+			}
+		}
+	case reflect.String:
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("%s: must be a string", key)
+		}
+	case reflect.Bool:
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: must be true or false", key)
+		}
+	case reflect.Int:
+		n, ok := v.(json.Number)
+		if _, err := strconv.Atoi(string(n)); !ok || err != nil {
+			return fmt.Errorf("%s: must be an integer", key)
+		}
+	default:
+		panic(fmt.Sprintf("unexpected config type: %v", t))
+	}
+	return nil
+}
+
+// validate checks the values in the config which are well typed, but may
+// still be wrong.
+func (c *userConfig) validate() error {
+	ids := make(map[string]bool, len(c.Repos))
+	for i := range c.Repos {
+		r := &c.Repos[i]
+		key := repoKey("repos", i, r.ID)
+		switch {
+		case r.ID == "":
+			return fmt.Errorf("%s.id: must not be empty", key)
+		case strings.ContainsAny(r.ID, `/\`):
+			return fmt.Errorf("%s.id: must not contain slashes", key)
+		case ids[r.ID]:
+			return fmt.Errorf("%s.id: another repo has the same ID", key)
+		}
+		ids[r.ID] = true
+		if err := checkRepoURL(r.URL); err != nil {
+			return fmt.Errorf("%s.url: %v", key, err)
+		}
+		for j, mirror := range r.Mirrors {
+			if err := checkRepoURL(mirror); err != nil {
+				return fmt.Errorf("%s.mirrors[%d]: %v", key, j, err)
+			}
+		}
+		if _, err := r.fingerprint(); err != nil {
+			return fmt.Errorf("%s.fingerprint: must be a SHA-256 fingerprint in hex", key)
+		}
+	}
+	pkgs := make([]string, 0, len(c.PinnedRepos))
+	for pkg := range c.PinnedRepos {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	for _, pkg := range pkgs {
+		if id := c.PinnedRepos[pkg]; !ids[id] {
+			return fmt.Errorf("pinnedRepos.%s: unknown repo %q", pkg, id)
+		}
+	}
+	if c.Proxy != "" {
+		if _, err := parseProxy(c.Proxy); err != nil {
+			return fmt.Errorf("proxy: %v", err)
+		}
+	}
+	for _, d := range []struct {
+		key   string
+		value string
+	}{
+		{"connectTimeout", c.ConnectTimeout},
+		{"idleTimeout", c.IdleTimeout},
+		{"retryDelay", c.RetryDelay},
+	} {
+		if d.value == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d.value); err != nil || v <= 0 {
+			return fmt.Errorf("%s: must be a positive duration such as \"30s\"", d.key)
+		}
+	}
+	if c.Retries != nil && *c.Retries < 0 {
+		return fmt.Errorf("retries: must not be negative")
+	}
+	return nil
+}
+
+func checkRepoURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("must be an http or https URL")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("missing host")
+	}
+	return nil
+}
+
+// configOption is an option in a decoded config, found by its key.
+type configOption struct {
+	typ   reflect.Type
+	value interface{}
+	set   func(v interface{})
+	// unset is nil if the option can't be removed, like a repo.
+	unset func()
+	// required is set for options which must always be present, like
+	// the list of repos.
+	required bool
+}
+
+// lookupConfig finds the option with the given key in a decoded config.
+// Objects missing along the way are added if create is set.
+func lookupConfig(raw map[string]interface{}, key string, create bool) (*configOption, error) {
+	t := reflect.TypeOf(userConfig{})
+	obj := raw
+	done, rest := "", key
+	for {
+		var name string
+		var ft reflect.Type
+		if t.Kind() == reflect.Map {
+			name, rest, ft = rest, "", t.Elem()
+		} else {
+			name, rest, _ = strings.Cut(rest, ".")
+			var ok bool
+			if ft, ok = jsonFields(t)[name]; !ok {
+				return nil, fmt.Errorf("%s: unknown key", joinKey(done, name))
+			}
+		}
+		if name == "" {
+			return nil, fmt.Errorf("invalid key %q", key)
+		}
+		done = joinKey(done, name)
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		parent := obj
+		if rest == "" {
+			return &configOption{
+				typ:      ft,
+				value:    parent[name],
+				set:      func(v interface{}) { parent[name] = v },
+				unset:    func() { delete(parent, name) },
+				required: t.Kind() == reflect.Struct && jsonRequired(t, name),
+			}, nil
+		}
+		switch ft.Kind() {
+		case reflect.Struct, reflect.Map:
+			child, ok := parent[name].(map[string]interface{})
+			if !ok {
+				if !create {
+					return &configOption{typ: ft}, nil
+				}
+				child = make(map[string]interface{})
+				parent[name] = child
+			}
+			obj, t = child, ft
+		case reflect.Slice:
+			if ft.Elem().Kind() != reflect.Struct {
+				return nil, fmt.Errorf("%s: a list has no keys", done)
+			}
+			// Repos are selected by their ID, which may contain
+			// dots, so use the longest matching one.
+			list, _ := parent[name].([]interface{})
+			index, id := -1, ""
+			for i, elem := range list {
+				m, _ := elem.(map[string]interface{})
+				eid, _ := m["id"].(string)
+				if len(eid) > len(id) && (rest == eid || strings.HasPrefix(rest, eid+".")) {
+					index, id = i, eid
+				}
+			}
+			if index == -1 {
+				repoID, _, _ := strings.Cut(rest, ".")
+				return nil, fmt.Errorf("%s: no repo with the ID %q", done, repoID)
+			}
+			done += "." + id
+			rest = strings.TrimPrefix(strings.TrimPrefix(rest, id), ".")
+			if rest == "" {
+				return &configOption{
+					typ:   ft.Elem(),
+					value: list[index],
+					set:   func(v interface{}) { list[index] = v },
+				}, nil
+			}
+			obj, t = list[index].(map[string]interface{}), ft.Elem()
+		default:
+			return nil, fmt.Errorf("%s: has no keys", done)
+		}
+	}
+}
+
+func rawConfig(c *userConfig) (map[string]interface{}, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRawConfig(b)
+}
+
+// redactedConfig returns a copy of the config without the passwords and
+// tokens of repos, so that it can be shown.
+func redactedConfig() userConfig {
+	c := config
+	c.Repos = make([]repo, len(config.Repos))
+	for i, r := range config.Repos {
+		if r.Auth != nil {
+			auth := *r.Auth
+			if auth.Password != "" {
+				auth.Password = "<redacted>"
+			}
+			if auth.Token != "" {
+				auth.Token = "<redacted>"
+			}
+			r.Auth = &auth
+		}
+		c.Repos[i] = r
+	}
+	return c
+}
+
+func getConfig(key string) error {
+	c := redactedConfig()
+	raw, err := rawConfig(&c)
+	if err != nil {
+		return err
+	}
+	opt, err := lookupConfig(raw, key, false)
+	if err != nil {
+		return err
+	}
+	if opt.value == nil {
+		return fmt.Errorf("%s is not set", key)
+	}
+	switch v := opt.value.(type) {
+	case string, bool, json.Number:
+		if !*jsonOutput {
+			fmt.Println(v)
+			return nil
+		}
+	}
+	return printJSON(opt.value)
+}
+
+// setConfig sets the option with the given key, or unsets it if value is nil,
+// and saves the config if it's still valid.
+func setConfig(key string, value *string) error {
+	if key == "version" {
+		return fmt.Errorf("version: cannot be changed")
+	}
+	raw, err := rawConfig(&config)
+	if err != nil {
+		return err
+	}
+	opt, err := lookupConfig(raw, key, value != nil)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		if opt.unset == nil {
+			return fmt.Errorf("%s: use 'fdroidcl repo remove' to remove repos", key)
+		}
+		if opt.required {
+			return fmt.Errorf("%s: cannot be unset", key)
+		}
+		if opt.value == nil {
+			return fmt.Errorf("%s is not set", key)
+		}
+		opt.unset()
+	} else {
+		v, err := parseConfigValue(opt.typ, *value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		opt.set(v)
+	}
+	c, err := checkConfig(raw)
+	if err != nil {
+		return err
+	}
+	if err := writeConfig(c); err != nil {
+		return err
+	}
+	// The repos or pins may have changed.
+	removeCache()
+	return nil
+}
+
+func parseConfigValue(t reflect.Type, s string) (interface{}, error) {
+	switch t.Kind() {
+	case reflect.String:
+		return s, nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid boolean: %q", s)
+		}
+		return b, nil
+	case reflect.Int:
+		if _, err := strconv.Atoi(s); err != nil {
+			return nil, fmt.Errorf("invalid integer: %q", s)
+		}
+		return json.Number(s), nil
+	}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("invalid JSON value: %v", err)
+	}
+	return v, nil
+}
+
+// editConfig lets the user edit a copy of the config, which replaces the
+// config only if it's valid.
+func editConfig() error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+		if runtime.GOOS == "windows" {
+			editor = "notepad"
+		}
+	}
+	b, err := json.MarshalIndent(&config, "", "\t")
+	if err != nil {
+		return fmt.Errorf("cannot encode config: %v", err)
+	}
+	f, err := os.CreateTemp(mustData(), "config.*.json")
+	if err != nil {
+		return err
+	}
+	path := f.Name()
+	_, err = f.Write(append(b, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	args := strings.Fields(editor)
+	cmd := exec.Command(args[0], append(args[1:], path)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("could not run editor: %v", err)
+	}
+	edited, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	c, err := parseConfig(edited)
+	if err != nil {
+		return fmt.Errorf("invalid config, not saved; the edited copy is at %s: %v", path, err)
+	}
+	os.Remove(path)
+	if err := writeConfig(c); err != nil {
+		return err
+	}
+	removeCache()
+	return nil
+}
@@ -4,14 +4,13 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"os"
 )
 
 var cmdDefaults = &Command{
 	UsageLine: "defaults",
 	Short:     "Reset to the default settings",
+	Mutates:   true,
 }
 
 func init() {
@@ -24,19 +23,3 @@ func runDefaults(args []string) error {
 	}
 	return writeConfig(&config)
 }
-
-func writeConfig(c *userConfig) error {
-	b, err := json.MarshalIndent(c, "", "\t")
-	if err != nil {
-		return fmt.Errorf("cannot encode config: %v", err)
-	}
-	f, err := os.Create(configPath())
-	if err != nil {
-		return fmt.Errorf("cannot create config file: %v", err)
-	}
-	_, err = f.Write(b)
-	if cerr := f.Close(); err == nil {
-		err = cerr
-	}
-	return err
-}
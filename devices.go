@@ -4,8 +4,12 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"strings"
+	"sync"
 
 	"mvdan.cc/fdroidcl/adb"
 )
@@ -27,6 +31,13 @@ func runDevices(args []string) error {
 	if err != nil {
 		return fmt.Errorf("could not get devices: %v", err)
 	}
+	if *jsonOutput {
+		list := make([]jsonDevice, len(devices))
+		for i, device := range devices {
+			list[i] = deviceJSON(device)
+		}
+		return printJSON(list)
+	}
 	for _, device := range devices {
 		fmt.Printf("%s - %s (%s)\n", device.ID, device.Model, device.Product)
 	}
@@ -76,3 +87,144 @@ func oneDevice() (*adb.Device, error) {
 	}
 	return device, err
 }
+
+// deviceSelection holds the flags which select the devices a command works
+// on. When neither is used, the single connected device is used.
+type deviceSelection struct {
+	serials string
+	all     bool
+}
+
+func deviceFlags(fset *flag.FlagSet) *deviceSelection {
+	s := &deviceSelection{}
+	fset.StringVar(&s.serials, "devices", "", "Use the devices with the given serials (comma-separated list)")
+	fset.BoolVar(&s.all, "all-devices", false, "Use all connected devices")
+	return s
+}
+
+func (s *deviceSelection) devices() ([]*adb.Device, error) {
+	if s.serials == "" && !s.all {
+		device, err := oneDevice()
+		if err != nil {
+			return nil, err
+		}
+		return []*adb.Device{device}, nil
+	}
+	if s.serials != "" && s.all {
+		return nil, fmt.Errorf("-all-devices cannot be used along with a list of serials")
+	}
+	if err := startAdbIfNeeded(); err != nil {
+		return nil, err
+	}
+	devices, err := adb.Devices()
+	if err != nil {
+		return nil, fmt.Errorf("could not get devices: %v", err)
+	}
+	if s.all {
+		if len(devices) < 1 {
+			return nil, fmt.Errorf("a connected device is needed")
+		}
+		return devices, nil
+	}
+	var selected []*adb.Device
+serials:
+	for _, serial := range strings.Split(s.serials, ",") {
+		serial = strings.TrimSpace(serial)
+		for _, device := range selected {
+			if device.ID == serial {
+				continue serials
+			}
+		}
+		for _, device := range devices {
+			if device.ID == serial {
+				selected = append(selected, device)
+				continue serials
+			}
+		}
+		return nil, fmt.Errorf("no device with serial %s found", serial)
+	}
+	return selected, nil
+}
+
+// deviceOutput prints the output of an operation on a device. When working
+// with multiple devices at once, lines are prefixed with the device serial
+// so that they can be told apart.
+type deviceOutput struct {
+	prefix string
+}
+
+// outputMu keeps lines printed by concurrent operations from interleaving.
+var outputMu sync.Mutex
+
+func newDeviceOutput(device *adb.Device, multiple bool) *deviceOutput {
+	if !multiple {
+		return &deviceOutput{}
+	}
+	return &deviceOutput{prefix: device.ID + ": "}
+}
+
+func (o *deviceOutput) Printf(format string, a ...interface{}) {
+	o.Fprintf(os.Stdout, format, a...)
+}
+
+func (o *deviceOutput) Fprintf(w io.Writer, format string, a ...interface{}) {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	if bars != nil && w == os.Stdout {
+		bars.printLines(o.prefix + fmt.Sprintf(format, a...))
+		return
+	}
+	fmt.Fprint(w, o.prefix+fmt.Sprintf(format, a...))
+}
+
+// lockedPrintf is like fmt.Printf, but safe to use while other operations or
+// progress bars are printing.
+func lockedPrintf(format string, a ...interface{}) {
+	(&deviceOutput{}).Printf(format, a...)
+}
+
+// lockedFprintf is like fmt.Fprintf, but safe to use while other operations
+// or progress bars are printing.
+func lockedFprintf(w io.Writer, format string, a ...interface{}) {
+	(&deviceOutput{}).Fprintf(w, format, a...)
+}
+
+// forEachDevice runs fn for each device index concurrently. The results and
+// errors are returned in the same order as the devices.
+func forEachDevice(devices []*adb.Device, fn func(int, *deviceOutput) (string, error)) ([]string, []error) {
+	results := make([]string, len(devices))
+	errs := make([]error, len(devices))
+	multiple := len(devices) > 1
+	var wg sync.WaitGroup
+	for i, device := range devices {
+		wg.Add(1)
+		go func(i int, device *adb.Device) {
+			defer wg.Done()
+			results[i], errs[i] = fn(i, newDeviceOutput(device, multiple))
+		}(i, device)
+	}
+	wg.Wait()
+	return results, errs
+}
+
+// deviceSummary prints the outcome of an operation on each device, if there
+// was more than one. The returned error is non-nil if any of them failed.
+func deviceSummary(devices []*adb.Device, results []string, errs []error) error {
+	if len(devices) == 1 {
+		return errs[0]
+	}
+	fmt.Println("Summary:")
+	failed := 0
+	for i, device := range devices {
+		if errs[i] != nil {
+			failed++
+			fmt.Printf("    %s (%s): %v\n", device.ID, device.Model, errs[i])
+		} else {
+			fmt.Printf("    %s (%s): %s\n", device.ID, device.Model, results[i])
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed on %d out of %d devices", failed, len(devices))
+	}
+	return nil
+}
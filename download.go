@@ -5,7 +5,9 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
+	"sync/atomic"
 
 	"mvdan.cc/fdroidcl/fdroid"
 )
@@ -13,8 +15,11 @@ import (
 var cmdDownload = &Command{
 	UsageLine: "download <appid...>",
 	Short:     "Download an app",
+	Mutates:   true,
 }
 
+var downloadJobs = cmdDownload.Fset.Int("j", 4, "Number of APKs to download at once")
+
 func init() {
 	cmdDownload.Run = runDownload
 }
@@ -27,32 +32,110 @@ func runDownload(args []string) error {
 	if err != nil {
 		return err
 	}
+	if *downloadJobs < 1 {
+		return fmt.Errorf("-j must be at least 1")
+	}
 	// don't fail a download if adb is not installed
 	device, _ := maybeOneDevice()
+	var downloads []*apkDownload
 	for _, app := range apps {
 		apk := app.SuggestedApk(device)
 		if apk == nil {
 			return fmt.Errorf("no suggested APK found for %s", app.PackageName)
 		}
-		path, err := downloadApk(apk)
-		if err != nil {
-			return err
+		downloads = append(downloads, newApkDownload(apk))
+	}
+	stopBars := startBars()
+	go downloadApks(downloads, *downloadJobs, false)
+	for _, d := range downloads {
+		<-d.done
+	}
+	stopBars()
+	for _, d := range downloads {
+		if d.err != nil {
+			return d.err
 		}
-		fmt.Printf("APK available in %s\n", path)
+		fmt.Printf("APK available in %s\n", d.path)
 	}
 	return nil
 }
 
+// apkDownload is an APK to be fetched by downloadApks. Once done is closed,
+// either path or err is set.
+type apkDownload struct {
+	apk  *fdroid.Apk
+	path string
+	err  error
+	done chan struct{}
+}
+
+func newApkDownload(apk *fdroid.Apk) *apkDownload {
+	return &apkDownload{apk: apk, done: make(chan struct{})}
+}
+
+var errDownloadCanceled = fmt.Errorf("download canceled after an earlier error")
+
+// downloadApks downloads the APKs in order, with at most jobs at a time.
+// Unless skipErrors is set, a failed download cancels the ones which haven't
+// started yet.
+func downloadApks(downloads []*apkDownload, jobs int, skipErrors bool) {
+	queue := make(chan *apkDownload)
+	var failed atomic.Bool
+	for i := 0; i < jobs; i++ {
+		go func() {
+			for d := range queue {
+				if failed.Load() {
+					d.err = errDownloadCanceled
+				} else if d.path, d.err = downloadApk(d.apk); d.err != nil && !skipErrors {
+					failed.Store(true)
+				}
+				close(d.done)
+			}
+		}()
+	}
+	for _, d := range downloads {
+		queue <- d
+	}
+	close(queue)
+}
+
 func downloadApk(apk *fdroid.Apk) (string, error) {
-	url := apk.URL()
 	path := apkPath(apk.ApkName)
-	if err := downloadEtag(url, path, apk.Hash); err == errNotModified {
+	mirrors := apk.Mirrors
+	if len(mirrors) == 0 {
+		mirrors = []string{apk.RepoURL}
+	}
+	if _, err := downloadMirrors(mirrors, apk.ApkName, path, apk.Hash, false, nil); err == errNotModified {
 	} else if err != nil {
 		return "", fmt.Errorf("could not download %s: %v", apk.AppID, err)
 	}
+	if err := verifyApkSigner(path, apk); err != nil {
+		// Don't leave the APK in the cache, where it could be picked up
+		// later on.
+		os.Remove(path)
+		return "", fmt.Errorf("could not verify %s: %v", apk.AppID, err)
+	}
 	return path, nil
 }
 
+// verifyApkSigner checks that the downloaded APK is signed by the signer
+// listed in the index, if any.
+func verifyApkSigner(path string, apk *fdroid.Apk) error {
+	if len(apk.Signer) == 0 {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return fdroid.VerifyApkSigner(f, info.Size(), apk.Signer)
+}
+
 func apkPath(apkname string) string {
 	apksDir := subdir(mustCache(), "apks")
 	return filepath.Join(apksDir, apkname)
@@ -0,0 +1,440 @@
+// Copyright (c) 2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package fdroid
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrSignerMismatch is returned when none of an APK's signers match the
+// signer listed in the index.
+var ErrSignerMismatch = errors.New("apk signer does not match the index")
+
+const (
+	apkSigBlockMagic = "APK Sig Block 42"
+	apkSigV2ID       = 0x7109871a
+	apkSigV3ID       = 0xf05368c0
+
+	// apkChunkSize is the size of the chunks that the content digests of
+	// the v2 and v3 schemes are computed over.
+	apkChunkSize = 1 << 20
+
+	eocdSize = 22
+)
+
+var errNoSigBlock = errors.New("apk has no signing block")
+
+// apkSigAlgos lists the signature algorithms of the v2 and v3 schemes we
+// support, in order of preference.
+var apkSigAlgos = []struct {
+	id   uint32
+	hash crypto.Hash
+	pss  bool
+}{
+	{0x0102, crypto.SHA512, true},
+	{0x0104, crypto.SHA512, false},
+	{0x0202, crypto.SHA512, false},
+	{0x0101, crypto.SHA256, true},
+	{0x0103, crypto.SHA256, false},
+	{0x0201, crypto.SHA256, false},
+}
+
+// VerifyApkSigner checks that the APK is signed by a certificate whose
+// SHA-256 fingerprint is the given one, like Apk.Signer.
+func VerifyApkSigner(r io.ReaderAt, size int64, fingerprint []byte) error {
+	certs, err := ApkSigners(r, size)
+	if err != nil {
+		return err
+	}
+	var got []string
+	for _, cert := range certs {
+		fp := CertFingerprint(cert.Raw)
+		if bytes.Equal(fp, fingerprint) {
+			return nil
+		}
+		got = append(got, hex.EncodeToString(fp))
+	}
+	return fmt.Errorf("%w: got %v, want %s", ErrSignerMismatch,
+		got, hex.EncodeToString(fingerprint))
+}
+
+// ApkSigners returns the certificates which signed an APK, after verifying
+// the signatures. The APK Signature Scheme v3 and v2 are preferred, falling
+// back to the v1 JAR signature for older APKs.
+func ApkSigners(r io.ReaderAt, size int64) ([]*x509.Certificate, error) {
+	sb, err := readSigBlock(r, size)
+	if err == errNoSigBlock {
+		return jarSigners(r, size)
+	} else if err != nil {
+		return nil, err
+	}
+	for _, id := range []uint32{apkSigV3ID, apkSigV2ID} {
+		if value, ok := sb.pairs[id]; ok {
+			return sb.verify(r, value, id == apkSigV3ID)
+		}
+	}
+	return jarSigners(r, size)
+}
+
+// ApkSignerFingerprints returns the SHA-256 fingerprints of the certificates
+// which signed an APK, like Apk.Signer. Unlike ApkSigners, the v2 and v3
+// signatures are not verified, so that as little of the APK as possible is
+// read. It is meant for APKs which were already verified, such as the ones
+// installed on a device.
+func ApkSignerFingerprints(r io.ReaderAt, size int64) ([][]byte, error) {
+	sb, err := readSigBlock(r, size)
+	if err != nil && err != errNoSigBlock {
+		return nil, err
+	}
+	var value []byte
+	if sb != nil {
+		// Both schemes start each signer with its signed data.
+		if value = sb.pairs[apkSigV3ID]; value == nil {
+			value = sb.pairs[apkSigV2ID]
+		}
+	}
+	if value == nil {
+		certs, err := jarSigners(r, size)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{CertFingerprint(certs[0].Raw)}, nil
+	}
+	signers, _, err := lengthPrefixed(value)
+	if err != nil {
+		return nil, err
+	}
+	var fps [][]byte
+	for len(signers) > 0 {
+		var signer []byte
+		if signer, signers, err = lengthPrefixed(signers); err != nil {
+			return nil, err
+		}
+		signedData, _, err := lengthPrefixed(signer)
+		if err != nil {
+			return nil, err
+		}
+		_, cert, err := parseSignedData(signedData)
+		if err != nil {
+			return nil, err
+		}
+		fps = append(fps, CertFingerprint(cert.Raw))
+	}
+	return fps, nil
+}
+
+func jarSigners(r io.ReaderAt, size int64) ([]*x509.Certificate, error) {
+	reader, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := JarSigner(reader)
+	if err != nil {
+		return nil, err
+	}
+	return []*x509.Certificate{cert}, nil
+}
+
+// sigBlock is an APK Signing Block, which sits right before the zip central
+// directory.
+type sigBlock struct {
+	start     int64 // offset of the signing block
+	cdStart   int64 // offset of the central directory
+	eocdStart int64 // offset of the end of central directory record
+	eocd      []byte
+	pairs     map[uint32][]byte
+}
+
+func readSigBlock(r io.ReaderAt, size int64) (*sigBlock, error) {
+	// The end of central directory record may be followed by a comment
+	// of up to 64KiB.
+	tailLen := int64(eocdSize + 0xffff)
+	if tailLen > size {
+		tailLen = size
+	}
+	tail := make([]byte, tailLen)
+	if _, err := r.ReadAt(tail, size-tailLen); err != nil {
+		return nil, err
+	}
+	i := len(tail) - eocdSize
+	for ; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(tail[i:]) == 0x06054b50 &&
+			int(binary.LittleEndian.Uint16(tail[i+20:])) == len(tail)-i-eocdSize {
+			break
+		}
+	}
+	if i < 0 {
+		return nil, errors.New("apk is not a valid zip archive")
+	}
+	sb := &sigBlock{
+		eocdStart: size - tailLen + int64(i),
+		eocd:      tail[i:],
+		cdStart:   int64(binary.LittleEndian.Uint32(tail[i+16:])),
+	}
+	cdSize := int64(binary.LittleEndian.Uint32(tail[i+12:]))
+	if sb.cdStart+cdSize != sb.eocdStart {
+		return nil, errors.New("apk has an invalid central directory")
+	}
+
+	footer := make([]byte, 24)
+	if sb.cdStart < int64(len(footer)) {
+		return nil, errNoSigBlock
+	}
+	if _, err := r.ReadAt(footer, sb.cdStart-24); err != nil {
+		return nil, err
+	}
+	if string(footer[8:]) != apkSigBlockMagic {
+		return nil, errNoSigBlock
+	}
+	blockSize := int64(binary.LittleEndian.Uint64(footer))
+	sb.start = sb.cdStart - blockSize - 8
+	if blockSize < 24 || sb.start < 0 {
+		return nil, errors.New("apk has an invalid signing block size")
+	}
+	block := make([]byte, blockSize+8)
+	if _, err := r.ReadAt(block, sb.start); err != nil {
+		return nil, err
+	}
+	if int64(binary.LittleEndian.Uint64(block)) != blockSize {
+		return nil, errors.New("apk signing block sizes do not match")
+	}
+	sb.pairs = make(map[uint32][]byte)
+	pairs := block[8 : len(block)-24]
+	for len(pairs) > 0 {
+		if len(pairs) < 12 {
+			return nil, errors.New("apk signing block is truncated")
+		}
+		n := binary.LittleEndian.Uint64(pairs)
+		if n < 4 || n > uint64(len(pairs)-8) {
+			return nil, errors.New("apk signing block has an invalid entry")
+		}
+		id := binary.LittleEndian.Uint32(pairs[8:])
+		sb.pairs[id] = pairs[12 : 8+n]
+		pairs = pairs[8+n:]
+	}
+	return sb, nil
+}
+
+// lengthPrefixed splits a value prefixed by its little-endian uint32 length
+// from the rest of the data.
+func lengthPrefixed(data []byte) (value, rest []byte, err error) {
+	if len(data) < 4 {
+		return nil, nil, errors.New("apk signature is truncated")
+	}
+	n := binary.LittleEndian.Uint32(data)
+	if uint64(n) > uint64(len(data)-4) {
+		return nil, nil, errors.New("apk signature has an invalid length")
+	}
+	return data[4 : 4+n], data[4+n:], nil
+}
+
+// verify checks each of the signers in a v2 or v3 signature, returning the
+// certificate of each of them.
+func (sb *sigBlock) verify(r io.ReaderAt, value []byte, v3 bool) ([]*x509.Certificate, error) {
+	signers, _, err := lengthPrefixed(value)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	digests := make(map[crypto.Hash][]byte)
+	for len(signers) > 0 {
+		var signer []byte
+		if signer, signers, err = lengthPrefixed(signers); err != nil {
+			return nil, err
+		}
+		cert, err := sb.verifySigner(r, signer, v3, digests)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("apk signature has no signers")
+	}
+	return certs, nil
+}
+
+func (sb *sigBlock) verifySigner(r io.ReaderAt, signer []byte, v3 bool, digests map[crypto.Hash][]byte) (*x509.Certificate, error) {
+	signedData, rest, err := lengthPrefixed(signer)
+	if err != nil {
+		return nil, err
+	}
+	if v3 {
+		// Skip the minimum and maximum SDK versions.
+		if len(rest) < 8 {
+			return nil, errors.New("apk signature is truncated")
+		}
+		rest = rest[8:]
+	}
+	signatures, rest, err := lengthPrefixed(rest)
+	if err != nil {
+		return nil, err
+	}
+	pubKeyDER, _, err := lengthPrefixed(rest)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, err := x509.ParsePKIXPublicKey(pubKeyDER)
+	if err != nil {
+		return nil, err
+	}
+
+	sigs := make(map[uint32][]byte)
+	for len(signatures) > 0 {
+		var sig []byte
+		if sig, signatures, err = lengthPrefixed(signatures); err != nil {
+			return nil, err
+		}
+		if len(sig) < 4 {
+			return nil, errors.New("apk signature is truncated")
+		}
+		if sigs[binary.LittleEndian.Uint32(sig)], _, err = lengthPrefixed(sig[4:]); err != nil {
+			return nil, err
+		}
+	}
+	algo := -1
+	for i, a := range apkSigAlgos {
+		if _, ok := sigs[a.id]; ok {
+			algo = i
+			break
+		}
+	}
+	if algo < 0 {
+		return nil, errors.New("apk signature uses no supported algorithms")
+	}
+	a := apkSigAlgos[algo]
+	h := a.hash.New()
+	h.Write(signedData)
+	hashed := h.Sum(nil)
+	sig := sigs[a.id]
+	switch pub := pubKey.(type) {
+	case *rsa.PublicKey:
+		if a.pss {
+			err = rsa.VerifyPSS(pub, a.hash, hashed, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			err = rsa.VerifyPKCS1v15(pub, a.hash, hashed, sig)
+		}
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, hashed, sig) {
+			err = errors.New("ecdsa verification failed")
+		}
+	default:
+		err = fmt.Errorf("unsupported public key type %T", pub)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid apk signature: %v", err)
+	}
+
+	// The signed data is now trusted.
+	digestList, cert, err := parseSignedData(signedData)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(cert.RawSubjectPublicKeyInfo, pubKeyDER) {
+		return nil, errors.New("apk signing certificate does not match the public key")
+	}
+	var want []byte
+	for len(digestList) > 0 {
+		var digest []byte
+		if digest, digestList, err = lengthPrefixed(digestList); err != nil {
+			return nil, err
+		}
+		if len(digest) >= 4 && binary.LittleEndian.Uint32(digest) == a.id {
+			if want, _, err = lengthPrefixed(digest[4:]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if want == nil {
+		return nil, errors.New("apk signature lacks a content digest")
+	}
+	got, ok := digests[a.hash]
+	if !ok {
+		if got, err = sb.contentDigest(r, a.hash); err != nil {
+			return nil, err
+		}
+		digests[a.hash] = got
+	}
+	if !bytes.Equal(got, want) {
+		return nil, errors.New("apk content digest mismatch")
+	}
+	return cert, nil
+}
+
+// parseSignedData returns the list of content digests and the signing
+// certificate from a signer's signed data.
+func parseSignedData(signedData []byte) (digests []byte, cert *x509.Certificate, err error) {
+	digests, rest, err := lengthPrefixed(signedData)
+	if err != nil {
+		return nil, nil, err
+	}
+	certList, _, err := lengthPrefixed(rest)
+	if err != nil {
+		return nil, nil, err
+	}
+	certDER, _, err := lengthPrefixed(certList)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err = x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, nil, err
+	}
+	return digests, cert, nil
+}
+
+// contentDigest computes the digest of the APK contents as done by the v2
+// and v3 schemes. The zip entries, the central directory and the end of
+// central directory record are split into chunks, which are digested
+// separately, and the top-level digest is computed over those.
+func (sb *sigBlock) contentDigest(r io.ReaderAt, hash crypto.Hash) ([]byte, error) {
+	// The signing block is not part of the signed contents, so the
+	// central directory offset is replaced with the block's offset.
+	eocd := append([]byte(nil), sb.eocd...)
+	binary.LittleEndian.PutUint32(eocd[16:], uint32(sb.start))
+	sections := []io.ReaderAt{
+		io.NewSectionReader(r, 0, sb.start),
+		io.NewSectionReader(r, sb.cdStart, sb.eocdStart-sb.cdStart),
+		bytes.NewReader(eocd),
+	}
+	sizes := []int64{sb.start, sb.eocdStart - sb.cdStart, int64(len(eocd))}
+
+	var chunkDigests []byte
+	count := 0
+	buf := make([]byte, apkChunkSize)
+	for i, section := range sections {
+		for off := int64(0); off < sizes[i]; off += apkChunkSize {
+			n := sizes[i] - off
+			if n > apkChunkSize {
+				n = apkChunkSize
+			}
+			if _, err := section.ReadAt(buf[:n], off); err != nil {
+				return nil, err
+			}
+			h := hash.New()
+			prefix := [5]byte{0xa5}
+			binary.LittleEndian.PutUint32(prefix[1:], uint32(n))
+			h.Write(prefix[:])
+			h.Write(buf[:n])
+			chunkDigests = h.Sum(chunkDigests)
+			count++
+		}
+	}
+	h := hash.New()
+	prefix := [5]byte{0x5a}
+	binary.LittleEndian.PutUint32(prefix[1:], uint32(count))
+	h.Write(prefix[:])
+	h.Write(chunkDigests)
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package fdroid
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	// redScreenSigner is the signer of the red_screen APKs in the test
+	// repo, as listed in its index.
+	redScreenSigner = "b9a9bdf27b4ab9c43a0c25d012ff7a3065703d64d45be5ecde378e76491cf100"
+	// testV2Signer is the key signing the v2 test repo and APK.
+	testV2Signer = "8a5056851cb528e994fd4f459261528cbedd76fcdf9a01e9705a725862f4fff3"
+)
+
+func TestVerifyApkSigner(t *testing.T) {
+	v1, err := os.ReadFile(filepath.Join("..", "testdata", "staticrepo", "org.vi_server.red_screen_2.apk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := os.ReadFile(filepath.Join("..", "testdata", "apksig", "red_screen_v2.apk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flip a byte in the first zip entry, which is covered by the v2
+	// content digest.
+	v2Tampered := append([]byte(nil), v2...)
+	v2Tampered[40] ^= 0xff
+
+	for _, c := range []struct {
+		name    string
+		apk     []byte
+		signer  string
+		wantErr string
+	}{
+		{"V1", v1, redScreenSigner, ""},
+		{"V1WrongSigner", v1, testV2Signer, ErrSignerMismatch.Error()},
+		{"V2", v2, testV2Signer, ""},
+		{"V2WrongSigner", v2, redScreenSigner, ErrSignerMismatch.Error()},
+		{"V2Tampered", v2Tampered, testV2Signer, "content digest mismatch"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			signer, _ := hex.DecodeString(c.signer)
+			err := VerifyApkSigner(bytes.NewReader(c.apk), int64(len(c.apk)), signer)
+			if c.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if c.wantErr != "" && (err == nil || !strings.Contains(err.Error(), c.wantErr)) {
+				t.Fatalf("want error containing %q, got %v", c.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestApkSignerFingerprints(t *testing.T) {
+	for _, c := range []struct {
+		path   string
+		signer string
+	}{
+		{filepath.Join("..", "testdata", "staticrepo", "org.vi_server.red_screen_2.apk"), redScreenSigner},
+		{filepath.Join("..", "testdata", "apksig", "red_screen_v2.apk"), testV2Signer},
+	} {
+		data, err := os.ReadFile(c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fps, err := ApkSignerFingerprints(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fps) != 1 || hex.EncodeToString(fps[0]) != c.signer {
+			t.Fatalf("%s: want signer %s, got %x", c.path, c.signer, fps)
+		}
+	}
+}
@@ -25,8 +25,8 @@ func (hv *HexVal) UnmarshalText(text []byte) error {
 }
 
 // UnixDate is F-Droid's timestamp format. It's a unix time, but in
-// milliseconds. We can ignore the extra digits, as they're always zero, and
-// won't be displayed anyway.
+// milliseconds. The milliseconds are kept, as index-v2 uses the exact
+// timestamps to identify diffs.
 type UnixDate struct {
 	time.Time
 }
@@ -40,7 +40,7 @@ func (ud *UnixDate) UnmarshalJSON(data []byte) error {
 	if err != nil {
 		return err
 	}
-	t := time.Unix(msec/1000, 0).UTC()
+	t := time.UnixMilli(msec).UTC()
 	*ud = UnixDate{t}
 	return nil
 }
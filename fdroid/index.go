@@ -30,6 +30,7 @@ type Repo struct {
 	Version     int      `json:"version"`
 	MaxAge      int      `json:"maxage"`
 	Description string   `json:"description"`
+	Mirrors     []string `json:"mirrors"`
 }
 
 // App is an Android application
@@ -43,6 +44,7 @@ type App struct {
 	Description    string   `json:"description"`
 	License        string   `json:"license"`
 	Categories     []string `json:"categories"`
+	AntiFeatures   []string `json:"antiFeatures"`
 	Website        string   `json:"webSite"`
 	SourceCode     string   `json:"sourceCode"`
 	IssueTracker   string   `json:"issueTracker"`
@@ -55,6 +57,9 @@ type App struct {
 	SugVersCode    int      `json:"suggestedVersionCode,string"`
 	FdroidRepoName string   `json:"-"`
 	FdroidRepoURL  string   `json:"-"`
+	// PinnedRepo is the name of the only repository whose APKs are
+	// suggested for the app, if set. It is filled in by the client.
+	PinnedRepo string `json:"-"`
 
 	Localized map[string]Localization `json:"localized"`
 
@@ -98,9 +103,14 @@ func getIconsDir(density IconDensity) string {
 }
 
 func (a *App) IconURLForDensity(density IconDensity) string {
-	if len(a.Apks) == 0 {
+	if len(a.Apks) == 0 || a.Icon == "" {
 		return ""
 	}
+	// Icons from index-v2 are paths within the repo, which are the same
+	// for all densities.
+	if strings.Contains(a.Icon, "/") {
+		return fmt.Sprintf("%s/%s", a.Apks[0].RepoURL, a.Icon)
+	}
 	return fmt.Sprintf("%s/%s/%s", a.Apks[0].RepoURL,
 		getIconsDir(density), a.Icon)
 }
@@ -213,8 +223,17 @@ type Apk struct {
 	Hash      HexVal       `json:"hash"`
 	HashType  string       `json:"hashType"`
 
+	AntiFeatures []string `json:"antiFeatures"`
+
 	AppID   string `json:"-"`
 	RepoURL string `json:"-"`
+	// RepoName is the name of the repository that the APK comes from.
+	// Like Mirrors, it is filled in by the client.
+	RepoName string `json:"-"`
+	// Mirrors lists the base URLs that the APK can be downloaded from, in
+	// order of preference. It is filled in by the client; if empty, only
+	// RepoURL is used.
+	Mirrors []string `json:"-"`
 }
 
 type Permission struct {
@@ -320,7 +339,49 @@ func LoadIndexJSON(r io.Reader) (*Index, error) {
 	if err := decoder.Decode(&index); err != nil {
 		return nil, err
 	}
+	index.prepare()
+	return &index, nil
+}
+
+// LoadIndexRepoJSON decodes only the repository metadata of an index-v1.json
+// document, which is much cheaper than loading the entire index.
+func LoadIndexRepoJSON(r io.Reader) (*Repo, error) {
+	var repo Repo
+	if err := decodeRepoJSON(r, &repo); err != nil {
+		return nil, err
+	}
+	return &repo, nil
+}
 
+// decodeRepoJSON decodes the "repo" field of an index document into v. It
+// stops reading as soon as it is found, which is cheap as indexes list the
+// repo metadata before the apps and packages.
+func decodeRepoJSON(r io.Reader, v interface{}) error {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil {
+		return err
+	} else if tok != json.Delim('{') {
+		return fmt.Errorf("index is not a JSON object")
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if tok == "repo" {
+			return dec.Decode(v)
+		}
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("index has no repo metadata")
+}
+
+// prepare sorts the apps and their apks, fills in fields derived from the
+// localized texts, and links each app to its apks.
+func (index *Index) prepare() {
 	sort.Sort(AppList(index.Apps))
 
 	for i := range index.Apps {
@@ -355,20 +416,26 @@ func LoadIndexJSON(r io.Reader) (*Index, error) {
 			app.Apks = append(app.Apks, apk)
 		}
 	}
-	return &index, nil
 }
 
 func (a *App) SuggestedApk(device *adb.Device) *Apk {
 	for _, apk := range a.Apks {
-		if a.SugVersCode >= apk.VersCode && apk.IsCompatible(device) {
+		if a.SugVersCode >= apk.VersCode && a.isCandidate(apk, device) {
 			return apk
 		}
 	}
 	// fall back to the first compatible apk
 	for _, apk := range a.Apks {
-		if apk.IsCompatible(device) {
+		if a.isCandidate(apk, device) {
 			return apk
 		}
 	}
 	return nil
 }
+
+func (a *App) isCandidate(apk *Apk, device *adb.Device) bool {
+	if a.PinnedRepo != "" && apk.RepoName != a.PinnedRepo {
+		return false
+	}
+	return apk.IsCompatible(device)
+}
@@ -155,3 +155,185 @@ func TestLoadIndexJSON(t *testing.T) {
 			strings.Join(pretty.Diff(want, got), "\n"))
 	}
 }
+
+func TestLoadIndexV2JSON(t *testing.T) {
+	in := `
+{
+	"repo": {
+		"name": {"en-US": "Foo"},
+		"address": "https://example.com/repo",
+		"timestamp": 1528184950000,
+		"mirrors": [{"url": "https://mirror.example.org/repo", "location": "de"}]
+	},
+	"packages": {
+		"foo.bar": {
+			"metadata": {
+				"added": 1443734950000,
+				"categories": ["Cat1"],
+				"name": {"de": "Foo bar DE", "en-US": "Foo bar"},
+				"summary": {"de": "nur deutsch\n"},
+				"icon": {"en-US": {"name": "/foo.bar/en-US/icon_a1b2.png", "sha256": "3e4c", "size": 30}}
+			},
+			"versions": {
+				"aa": {
+					"file": {"name": "/foo.bar_1.apk", "sha256": "1e4c", "size": 10},
+					"manifest": {
+						"versionName": "1.0",
+						"versionCode": 1,
+						"usesSdk": {"minSdkVersion": 21},
+						"signer": {"sha256": ["573c"]},
+						"usesPermission": [{"name": "INTERNET"}, {"name": "STORAGE", "maxSdkVersion": 18}]
+					},
+					"antiFeatures": {"Ads": {}, "Tracking": {}}
+				},
+				"bb": {
+					"file": {"name": "/foo.bar_2.apk", "sha256": "2e4c", "size": 20},
+					"manifest": {"versionName": "2.0-beta", "versionCode": 2},
+					"releaseChannels": ["Beta"]
+				}
+			}
+		}
+	}
+}
+`
+	want := Index{
+		Repo: Repo{
+			Name:      "Foo",
+			Address:   "https://example.com/repo",
+			Timestamp: UnixDate{time.Unix(1528184950, 0).UTC()},
+			Mirrors:   []string{"https://mirror.example.org/repo"},
+		},
+		Apps: []App{{
+			PackageName:  "foo.bar",
+			Name:         "Foo bar",
+			Summary:      "nur deutsch",
+			Icon:         "foo.bar/en-US/icon_a1b2.png",
+			Categories:   []string{"Cat1"},
+			AntiFeatures: []string{"Ads", "Tracking"},
+			Added:        UnixDate{time.Unix(1443734950, 0).UTC()},
+			SugVersName:  "1.0",
+			SugVersCode:  1,
+			Localized: map[string]Localization{
+				"de":    {Name: "Foo bar DE", Summary: "nur deutsch\n"},
+				"en-US": {Name: "Foo bar"},
+			},
+			Apks: []*Apk{nil, nil},
+		}},
+		Packages: map[string][]Apk{"foo.bar": {
+			{
+				VersName: "2.0-beta",
+				VersCode: 2,
+				Size:     20,
+				ApkName:  "foo.bar_2.apk",
+				Hash:     HexVal{0x2e, 0x4c},
+				HashType: "sha256",
+				AppID:    "foo.bar",
+				RepoURL:  "https://example.com/repo",
+			},
+			{
+				VersName: "1.0",
+				VersCode: 1,
+				Size:     10,
+				MinSdk:   StringInt{21},
+				ApkName:  "foo.bar_1.apk",
+				Signer:   HexVal{0x57, 0x3c},
+				Perms: []Permission{
+					{Name: "INTERNET"},
+					{Name: "STORAGE", MaxSdk: "18"},
+				},
+				Hash:         HexVal{0x1e, 0x4c},
+				HashType:     "sha256",
+				AntiFeatures: []string{"Ads", "Tracking"},
+				AppID:        "foo.bar",
+				RepoURL:      "https://example.com/repo",
+			},
+		}},
+	}
+	want.Apps[0].Apks[0] = &want.Packages["foo.bar"][0]
+	want.Apps[0].Apks[1] = &want.Packages["foo.bar"][1]
+	index, err := LoadIndexV2JSON(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	got := *index
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Unexpected index.\n%s",
+			strings.Join(pretty.Diff(want, got), "\n"))
+	}
+	if apk := got.Apps[0].SuggestedApk(nil); apk.VersCode != 1 {
+		t.Fatalf("Beta version should not be suggested, got %d", apk.VersCode)
+	}
+	if url, want := got.Apps[0].IconURLForDensity(HighDensity), "https://example.com/repo/foo.bar/en-US/icon_a1b2.png"; url != want {
+		t.Fatalf("Unexpected icon URL %q, want %q", url, want)
+	}
+}
+
+func TestPatchIndexV2JSON(t *testing.T) {
+	index := `{"repo": {"timestamp": 1700000000001, "name": {"en-US": "Foo"}}, "packages": {"a": {"x": 1}, "b": {"y": [1, 2]}}}`
+	diff := `{"repo": {"timestamp": 1700000000002}, "packages": {"a": null, "b": {"y": [3], "z": {"k": "v"}}}}`
+	want := `{"packages":{"b":{"y":[3],"z":{"k":"v"}}},"repo":{"name":{"en-US":"Foo"},"timestamp":1700000000002}}` + "\n"
+
+	var buf bytes.Buffer
+	if err := PatchIndexV2JSON(&buf, strings.NewReader(index), strings.NewReader(diff)); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != want {
+		t.Fatalf("Unexpected patched index.\nGot:\n%s\nWant:\n%s", got, want)
+	}
+	ts, err := IndexV2Timestamp(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts != 1700000000002 {
+		t.Fatalf("Unexpected timestamp: %d", ts)
+	}
+}
+
+func TestLoadIndexRepoJSON(t *testing.T) {
+	in := `{"apps": [{"packageName": "foo.bar"}], "repo": {"name": "Foo", "maxage": 14, "timestamp": 1528184950123, "mirrors": ["https://mirror.example.org/repo"]}, "packages": {}}`
+	repo, err := LoadIndexRepoJSON(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Repo{
+		Name:      "Foo",
+		MaxAge:    14,
+		Timestamp: UnixDate{time.UnixMilli(1528184950123).UTC()},
+		Mirrors:   []string{"https://mirror.example.org/repo"},
+	}
+	if !reflect.DeepEqual(*repo, want) {
+		t.Fatalf("Unexpected repo.\n%s", strings.Join(pretty.Diff(want, *repo), "\n"))
+	}
+}
+
+func TestSuggestedApkPinned(t *testing.T) {
+	app := App{
+		SugVersCode: 2,
+		Apks: []*Apk{
+			{VersCode: 3, RepoName: "upstream"},
+			{VersCode: 2, RepoName: "main"},
+			{VersCode: 2, RepoName: "upstream"},
+			{VersCode: 1, RepoName: "main"},
+		},
+	}
+	tests := []struct {
+		pinned   string
+		wantRepo string
+		wantCode int
+	}{
+		{"", "main", 2},
+		{"main", "main", 2},
+		{"upstream", "upstream", 2},
+	}
+	for _, tc := range tests {
+		app.PinnedRepo = tc.pinned
+		apk := app.SuggestedApk(nil)
+		if apk == nil || apk.RepoName != tc.wantRepo || apk.VersCode != tc.wantCode {
+			t.Errorf("pinned to %q: got %+v, want %d from %s", tc.pinned, apk, tc.wantCode, tc.wantRepo)
+		}
+	}
+	app.PinnedRepo = "other"
+	if apk := app.SuggestedApk(nil); apk != nil {
+		t.Errorf("pinned to a repo without APKs: got %+v, want nil", apk)
+	}
+}
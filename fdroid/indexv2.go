@@ -0,0 +1,361 @@
+// Copyright (c) 2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package fdroid
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Entry is the signed entry point of an index-v2 repository. It points to
+// the full index, as well as to diffs against older versions of it.
+type Entry struct {
+	Timestamp UnixDate          `json:"timestamp"`
+	Version   int               `json:"version"`
+	MaxAge    int               `json:"maxAge"`
+	Index     FileV2            `json:"index"`
+	Diffs     map[string]FileV2 `json:"diffs"`
+}
+
+// FileV2 describes a file in an index-v2 repository. The name is a path
+// relative to the repository address, starting with a slash.
+type FileV2 struct {
+	Name        string `json:"name"`
+	Sha256      HexVal `json:"sha256"`
+	Size        int64  `json:"size"`
+	NumPackages int    `json:"numPackages"`
+}
+
+func LoadEntryJSON(r io.Reader) (*Entry, error) {
+	var entry Entry
+	if err := json.NewDecoder(r).Decode(&entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// localizedText maps locales such as "en-US" to translated strings.
+type localizedText map[string]string
+
+// preferredLocales mirrors the English fallback done for index-v1.
+var preferredLocales = []string{"en", "en-US"}
+
+// best returns the English text if there is one, or else the text of the
+// first locale in alphabetical order.
+func (lt localizedText) best() string {
+	for _, locale := range preferredLocales {
+		if s, ok := lt[locale]; ok {
+			return s
+		}
+	}
+	locales := make([]string, 0, len(lt))
+	for locale := range lt {
+		locales = append(locales, locale)
+	}
+	if len(locales) == 0 {
+		return ""
+	}
+	sort.Strings(locales)
+	return lt[locales[0]]
+}
+
+type localizedFile map[string]FileV2
+
+func (lf localizedFile) best() FileV2 {
+	names := make(localizedText, len(lf))
+	for locale := range lf {
+		names[locale] = locale
+	}
+	return lf[names.best()]
+}
+
+type indexV2 struct {
+	Repo     repoV2               `json:"repo"`
+	Packages map[string]packageV2 `json:"packages"`
+}
+
+type repoV2 struct {
+	Name        localizedText `json:"name"`
+	Icon        localizedFile `json:"icon"`
+	Address     string        `json:"address"`
+	Description localizedText `json:"description"`
+	Timestamp   UnixDate      `json:"timestamp"`
+	Mirrors     []struct {
+		URL string `json:"url"`
+	} `json:"mirrors"`
+}
+
+type packageV2 struct {
+	Metadata metadataV2           `json:"metadata"`
+	Versions map[string]versionV2 `json:"versions"`
+}
+
+type metadataV2 struct {
+	Added        UnixDate      `json:"added"`
+	LastUpdated  UnixDate      `json:"lastUpdated"`
+	Name         localizedText `json:"name"`
+	Summary      localizedText `json:"summary"`
+	Description  localizedText `json:"description"`
+	Icon         localizedFile `json:"icon"`
+	License      string        `json:"license"`
+	Categories   []string      `json:"categories"`
+	WebSite      string        `json:"webSite"`
+	SourceCode   string        `json:"sourceCode"`
+	IssueTracker string        `json:"issueTracker"`
+	Changelog    string        `json:"changelog"`
+	Donate       []string      `json:"donate"`
+	Bitcoin      string        `json:"bitcoin"`
+	Litecoin     string        `json:"litecoin"`
+	FlattrID     string        `json:"flattrID"`
+}
+
+type versionV2 struct {
+	Added           UnixDate                 `json:"added"`
+	File            FileV2                   `json:"file"`
+	Src             *FileV2                  `json:"src"`
+	Manifest        manifestV2               `json:"manifest"`
+	ReleaseChannels []string                 `json:"releaseChannels"`
+	AntiFeatures    map[string]localizedText `json:"antiFeatures"`
+}
+
+type manifestV2 struct {
+	VersionName string `json:"versionName"`
+	VersionCode int    `json:"versionCode"`
+	UsesSdk     struct {
+		MinSdkVersion    int `json:"minSdkVersion"`
+		TargetSdkVersion int `json:"targetSdkVersion"`
+	} `json:"usesSdk"`
+	MaxSdkVersion int `json:"maxSdkVersion"`
+	Signer        struct {
+		Sha256 []string `json:"sha256"`
+	} `json:"signer"`
+	UsesPermission      []permissionV2 `json:"usesPermission"`
+	UsesPermissionSdk23 []permissionV2 `json:"usesPermissionSdk23"`
+	Nativecode          []string       `json:"nativecode"`
+	Features            []struct {
+		Name string `json:"name"`
+	} `json:"features"`
+}
+
+type permissionV2 struct {
+	Name          string `json:"name"`
+	MaxSdkVersion int    `json:"maxSdkVersion"`
+}
+
+// LoadIndexV2JSON reads an index-v2.json file, converting it to the same
+// Index structure used for index-v1.
+func LoadIndexV2JSON(r io.Reader) (*Index, error) {
+	var v2 indexV2
+	if err := json.NewDecoder(r).Decode(&v2); err != nil {
+		return nil, err
+	}
+	index := v2.toIndex()
+	index.prepare()
+	return index, nil
+}
+
+func (v2 *indexV2) toIndex() *Index {
+	index := &Index{
+		Repo:     v2.Repo.toRepo(),
+		Apps:     make([]App, 0, len(v2.Packages)),
+		Packages: make(map[string][]Apk, len(v2.Packages)),
+	}
+	for name, pkg := range v2.Packages {
+		apks := make([]Apk, 0, len(pkg.Versions))
+		for _, v := range pkg.Versions {
+			apks = append(apks, v.toApk())
+		}
+		index.Packages[name] = apks
+		index.Apps = append(index.Apps, pkg.toApp(name))
+	}
+	return index
+}
+
+func (r *repoV2) toRepo() Repo {
+	repo := Repo{
+		Name:        r.Name.best(),
+		Timestamp:   r.Timestamp,
+		Address:     r.Address,
+		Icon:        strings.TrimPrefix(r.Icon.best().Name, "/"),
+		Description: r.Description.best(),
+	}
+	for _, m := range r.Mirrors {
+		repo.Mirrors = append(repo.Mirrors, m.URL)
+	}
+	return repo
+}
+
+func (pkg *packageV2) toApp(name string) App {
+	m := &pkg.Metadata
+	app := App{
+		PackageName:  name,
+		Name:         m.Name.best(),
+		Summary:      m.Summary.best(),
+		Description:  m.Description.best(),
+		Icon:         strings.TrimPrefix(m.Icon.best().Name, "/"),
+		Added:        m.Added,
+		Updated:      m.LastUpdated,
+		License:      m.License,
+		Categories:   m.Categories,
+		Website:      m.WebSite,
+		SourceCode:   m.SourceCode,
+		IssueTracker: m.IssueTracker,
+		Changelog:    m.Changelog,
+		Bitcoin:      m.Bitcoin,
+		Litecoin:     m.Litecoin,
+		FlattrID:     m.FlattrID,
+	}
+	if len(m.Donate) > 0 {
+		app.Donate = m.Donate[0]
+	}
+	for _, lt := range []localizedText{m.Name, m.Summary, m.Description} {
+		for locale := range lt {
+			if app.Localized == nil {
+				app.Localized = make(map[string]Localization)
+			}
+			app.Localized[locale] = Localization{
+				Name:        m.Name[locale],
+				Summary:     m.Summary[locale],
+				Description: m.Description[locale],
+			}
+		}
+	}
+
+	// index-v2 has no suggested version; like the F-Droid client, suggest
+	// the latest version which isn't in a release channel such as "Beta".
+	var suggested *versionV2
+	for k := range pkg.Versions {
+		v := pkg.Versions[k]
+		switch {
+		case suggested == nil,
+			v.stable() && !suggested.stable(),
+			v.stable() == suggested.stable() && v.Manifest.VersionCode > suggested.Manifest.VersionCode:
+			suggested = &v
+		}
+	}
+	if suggested != nil {
+		app.SugVersName = suggested.Manifest.VersionName
+		app.SugVersCode = suggested.Manifest.VersionCode
+		app.AntiFeatures = suggested.antiFeatures()
+	}
+	return app
+}
+
+func (v *versionV2) stable() bool {
+	return len(v.ReleaseChannels) == 0
+}
+
+func (v *versionV2) antiFeatures() []string {
+	if len(v.AntiFeatures) == 0 {
+		return nil
+	}
+	list := make([]string, 0, len(v.AntiFeatures))
+	for name := range v.AntiFeatures {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func (v *versionV2) toApk() Apk {
+	m := &v.Manifest
+	apk := Apk{
+		VersName:     m.VersionName,
+		VersCode:     m.VersionCode,
+		Size:         v.File.Size,
+		MinSdk:       StringInt{m.UsesSdk.MinSdkVersion},
+		MaxSdk:       StringInt{m.MaxSdkVersion},
+		TargetSdk:    StringInt{m.UsesSdk.TargetSdkVersion},
+		ABIs:         m.Nativecode,
+		ApkName:      strings.TrimPrefix(v.File.Name, "/"),
+		Added:        v.Added,
+		Hash:         v.File.Sha256,
+		HashType:     "sha256",
+		AntiFeatures: v.antiFeatures(),
+	}
+	if v.Src != nil {
+		apk.SrcName = strings.TrimPrefix(v.Src.Name, "/")
+	}
+	if len(m.Signer.Sha256) > 0 {
+		apk.Signer, _ = hex.DecodeString(m.Signer.Sha256[0])
+	}
+	for _, list := range [][]permissionV2{m.UsesPermission, m.UsesPermissionSdk23} {
+		for _, p := range list {
+			perm := Permission{Name: p.Name}
+			if p.MaxSdkVersion > 0 {
+				perm.MaxSdk = strconv.Itoa(p.MaxSdkVersion)
+			}
+			apk.Perms = append(apk.Perms, perm)
+		}
+	}
+	for _, f := range m.Features {
+		apk.Feats = append(apk.Feats, f.Name)
+	}
+	return apk
+}
+
+// LoadIndexV2RepoJSON decodes only the repository metadata of an
+// index-v2.json document, like LoadIndexRepoJSON.
+func LoadIndexV2RepoJSON(r io.Reader) (*Repo, error) {
+	var v2 repoV2
+	if err := decodeRepoJSON(r, &v2); err != nil {
+		return nil, err
+	}
+	repo := v2.toRepo()
+	return &repo, nil
+}
+
+// IndexV2Timestamp returns the repo timestamp of an index-v2.json document,
+// in milliseconds, without decoding the rest of the index.
+func IndexV2Timestamp(r io.Reader) (int64, error) {
+	var repo struct {
+		Timestamp int64 `json:"timestamp"`
+	}
+	if err := decodeRepoJSON(r, &repo); err != nil {
+		return 0, err
+	}
+	return repo.Timestamp, nil
+}
+
+// PatchIndexV2JSON applies one of the diffs listed in an Entry to an
+// index-v2.json document, writing the updated document to w. Diffs are JSON
+// merge patches, as described in RFC 7386.
+func PatchIndexV2JSON(w io.Writer, index, diff io.Reader) error {
+	var doc, patch interface{}
+	for _, v := range []struct {
+		r   io.Reader
+		dst *interface{}
+	}{{index, &doc}, {diff, &patch}} {
+		dec := json.NewDecoder(v.r)
+		// Keep numbers such as timestamps exactly as they are.
+		dec.UseNumber()
+		if err := dec.Decode(v.dst); err != nil {
+			return err
+		}
+	}
+	return json.NewEncoder(w).Encode(mergePatch(doc, patch))
+}
+
+func mergePatch(doc, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	docObj, ok := doc.(map[string]interface{})
+	if !ok {
+		docObj = make(map[string]interface{}, len(patchObj))
+	}
+	for key, val := range patchObj {
+		if val == nil {
+			delete(docObj, key)
+		} else {
+			docObj[key] = mergePatch(docObj[key], val)
+		}
+	}
+	return docObj
+}
@@ -9,28 +9,85 @@ import (
 	"io"
 )
 
-const indexPath = "index-v1.json"
+const (
+	indexPath = "index-v1.json"
+	entryPath = "entry.json"
+)
+
+var (
+	ErrNoIndex = errors.New("no json index found inside jar")
+	ErrNoEntry = errors.New("no json entry found inside jar")
+)
+
+// LoadIndexJar reads the JSON index contained in an index-v1.jar. If
+// fingerprint is non-nil, the jar's signature is verified first, and its
+// signing certificate must have the given SHA-256 fingerprint.
+func LoadIndexJar(r io.ReaderAt, size int64, fingerprint []byte) (*Index, error) {
+	index, err := openSignedJarFile(r, size, fingerprint, indexPath)
+	if err != nil {
+		if err == errNotFound {
+			err = ErrNoIndex
+		}
+		return nil, err
+	}
+	defer index.Close()
+	return LoadIndexJSON(index)
+}
+
+// LoadIndexJarRepo reads only the repository metadata from an index-v1.jar.
+// Unlike LoadIndexJar, it does not verify the jar's signature.
+func LoadIndexJarRepo(r io.ReaderAt, size int64) (*Repo, error) {
+	index, err := openSignedJarFile(r, size, nil, indexPath)
+	if err != nil {
+		if err == errNotFound {
+			err = ErrNoIndex
+		}
+		return nil, err
+	}
+	defer index.Close()
+	return LoadIndexRepoJSON(index)
+}
 
-var ErrNoIndex = errors.New("no json index found inside jar")
+// LoadEntryJar reads the index-v2 entry contained in an entry.jar, verifying
+// its signature like LoadIndexJar.
+func LoadEntryJar(r io.ReaderAt, size int64, fingerprint []byte) (*Entry, error) {
+	entry, err := openSignedJarFile(r, size, fingerprint, entryPath)
+	if err != nil {
+		if err == errNotFound {
+			err = ErrNoEntry
+		}
+		return nil, err
+	}
+	defer entry.Close()
+	return LoadEntryJSON(entry)
+}
 
-func LoadIndexJar(r io.ReaderAt, size int64, pubkey []byte) (*Index, error) {
+// VerifyIndexJar checks that the jar is correctly signed by a certificate
+// with the given SHA-256 fingerprint, without decoding the index itself.
+func VerifyIndexJar(r io.ReaderAt, size int64, fingerprint []byte) error {
+	reader, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	return verifyJar(reader, fingerprint)
+}
+
+var errNotFound = errors.New("file not found")
+
+func openSignedJarFile(r io.ReaderAt, size int64, fingerprint []byte, name string) (io.ReadCloser, error) {
 	reader, err := zip.NewReader(r, size)
 	if err != nil {
 		return nil, err
 	}
-	var index io.ReadCloser
-	for _, f := range reader.File {
-		if f.Name == indexPath {
-			index, err = f.Open()
-			if err != nil {
-				return nil, err
-			}
-			break
+	if fingerprint != nil {
+		if err := verifyJar(reader, fingerprint); err != nil {
+			return nil, err
 		}
 	}
-	if index == nil {
-		return nil, ErrNoIndex
+	for _, f := range reader.File {
+		if f.Name == name {
+			return f.Open()
+		}
 	}
-	defer index.Close()
-	return LoadIndexJSON(index)
+	return nil, errNotFound
 }
@@ -0,0 +1,107 @@
+// Copyright (c) 2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package fdroid
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const fdroidFingerprint = "43238d512c1e5eb2d6569f4a3afbf5523418b82e0a3ed1552770abb9a9c9ccab"
+
+func TestVerifyIndexJar(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("..", "testdata", "staticrepo", "index-v1.jar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, _ := hex.DecodeString(fdroidFingerprint)
+	bad := append([]byte(nil), good...)
+	bad[0] ^= 0xff
+
+	// Replace the contents of the index, keeping the signature files.
+	var tampered bytes.Buffer
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(&tampered)
+	for _, f := range zr.File {
+		w, err := zw.Create(f.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Name == indexPath {
+			io.WriteString(w, `{"repo": {}, "apps": []}`)
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(w, rc)
+		rc.Close()
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name        string
+		jar         []byte
+		fingerprint []byte
+		wantErr     bool
+	}{
+		{"Valid", data, good, false},
+		{"WrongFingerprint", data, bad, true},
+		{"TamperedIndex", tampered.Bytes(), good, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			err := VerifyIndexJar(bytes.NewReader(c.jar), int64(len(c.jar)), c.fingerprint)
+			if c.wantErr && err == nil {
+				t.Fatalf("expected an error")
+			} else if !c.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+	err = VerifyIndexJar(bytes.NewReader(data), int64(len(data)), bad)
+	if !errors.Is(err, ErrFingerprintMismatch) {
+		t.Fatalf("want ErrFingerprintMismatch, got %v", err)
+	}
+}
+
+func TestLoadEntryJar(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("..", "testdata", "staticrepo", "v2", "entry.jar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint, _ := hex.DecodeString("8a5056851cb528e994fd4f459261528cbedd76fcdf9a01e9705a725862f4fff3")
+	entry, err := LoadEntryJar(bytes.NewReader(data), int64(len(data)), fingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Index.Name != "/index-v2.json" || len(entry.Index.Sha256) != 32 {
+		t.Fatalf("Unexpected entry index: %#v", entry.Index)
+	}
+	good, _ := hex.DecodeString(fdroidFingerprint)
+	_, err = LoadEntryJar(bytes.NewReader(data), int64(len(data)), good)
+	if !errors.Is(err, ErrFingerprintMismatch) {
+		t.Fatalf("want ErrFingerprintMismatch, got %v", err)
+	}
+}
+
+func TestVerifySignatureFileEmptyManifest(t *testing.T) {
+	sf := []byte("Signature-Version: 1.0\r\n\r\nName: index-v1.json\r\nSHA-256-Digest: AAAA\r\n\r\n")
+	for _, manifest := range []string{"", "\r\n", "garbage without attributes\r\n"} {
+		if err := verifySignatureFile(sf, []byte(manifest)); err == nil {
+			t.Errorf("manifest %q: want an error, got nil", manifest)
+		}
+	}
+}
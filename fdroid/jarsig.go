@@ -0,0 +1,395 @@
+// Copyright (c) 2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package fdroid
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	_ "crypto/sha1"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"path"
+	"strings"
+)
+
+var (
+	ErrNoSignature         = errors.New("jar is not signed")
+	ErrFingerprintMismatch = errors.New("jar signer does not match the pinned fingerprint")
+)
+
+// CertFingerprint returns the SHA-256 fingerprint of a DER-encoded
+// certificate, which is how F-Droid identifies repository signing keys.
+func CertFingerprint(der []byte) []byte {
+	sum := sha256.Sum256(der)
+	return sum[:]
+}
+
+// JarSigner returns the certificate that signed the jar, after verifying
+// that the signature covers all of its files.
+func JarSigner(reader *zip.Reader) (*x509.Certificate, error) {
+	files := make(map[string]*zip.File, len(reader.File))
+	var blockName string
+	for _, f := range reader.File {
+		files[f.Name] = f
+		dir, base := path.Split(f.Name)
+		if dir != "META-INF/" {
+			continue
+		}
+		switch path.Ext(base) {
+		case ".RSA", ".DSA", ".EC":
+			if blockName != "" {
+				return nil, fmt.Errorf("jar has multiple signature blocks")
+			}
+			blockName = f.Name
+		}
+	}
+	if blockName == "" {
+		return nil, ErrNoSignature
+	}
+	sfName := strings.TrimSuffix(blockName, path.Ext(blockName)) + ".SF"
+	block, err := readZipFile(files[blockName])
+	if err != nil {
+		return nil, err
+	}
+	sf, err := readZipFile(files[sfName])
+	if err != nil {
+		return nil, fmt.Errorf("missing %s: %v", sfName, err)
+	}
+	manifest, err := readZipFile(files["META-INF/MANIFEST.MF"])
+	if err != nil {
+		return nil, fmt.Errorf("missing manifest: %v", err)
+	}
+
+	cert, err := verifyPKCS7(block, sf)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature block: %v", err)
+	}
+	if err := verifySignatureFile(sf, manifest); err != nil {
+		return nil, err
+	}
+	if err := verifyManifest(manifest, reader.File); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+func verifyJar(reader *zip.Reader, fingerprint []byte) error {
+	cert, err := JarSigner(reader)
+	if err != nil {
+		return err
+	}
+	if got := CertFingerprint(cert.Raw); !bytes.Equal(got, fingerprint) {
+		return fmt.Errorf("%w: got %s, want %s", ErrFingerprintMismatch,
+			hex.EncodeToString(got), hex.EncodeToString(fingerprint))
+	}
+	return nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	if f == nil {
+		return nil, errNotFound
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// manifestSection is a group of "Key: value" lines in a jar manifest or
+// signature file, along with its raw bytes for digesting.
+type manifestSection struct {
+	raw   []byte
+	attrs map[string]string
+}
+
+func parseManifest(data []byte) []manifestSection {
+	var sections []manifestSection
+	cur := manifestSection{attrs: make(map[string]string)}
+	lastKey := ""
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line = data[:i+1]
+		}
+		data = data[len(line):]
+		cur.raw = append(cur.raw, line...)
+		text := strings.TrimRight(string(line), "\r\n")
+		switch {
+		case text == "":
+			// A blank line ends the section, and is part of it.
+			if len(cur.attrs) > 0 {
+				sections = append(sections, cur)
+			}
+			cur = manifestSection{attrs: make(map[string]string)}
+			lastKey = ""
+		case text[0] == ' ':
+			if lastKey != "" {
+				cur.attrs[lastKey] += text[1:]
+			}
+		default:
+			if i := strings.Index(text, ": "); i > 0 {
+				lastKey = text[:i]
+				cur.attrs[lastKey] = text[i+2:]
+			}
+		}
+	}
+	if len(cur.attrs) > 0 {
+		sections = append(sections, cur)
+	}
+	return sections
+}
+
+var digestAlgos = []struct {
+	prefix string
+	hash   crypto.Hash
+}{
+	{"SHA-512", crypto.SHA512},
+	{"SHA-384", crypto.SHA384},
+	{"SHA-256", crypto.SHA256},
+	{"SHA1", crypto.SHA1},
+}
+
+// checkDigests verifies all the digest attributes with the given suffix,
+// such as "-Digest" or "-Digest-Manifest", against data. At least one
+// supported digest must be present.
+func checkDigests(attrs map[string]string, suffix string, data []byte) (bool, error) {
+	found := false
+	for _, algo := range digestAlgos {
+		val, ok := attrs[algo.prefix+suffix]
+		if !ok {
+			continue
+		}
+		want, err := base64.StdEncoding.DecodeString(val)
+		if err != nil {
+			return false, err
+		}
+		h := algo.hash.New()
+		h.Write(data)
+		if !bytes.Equal(h.Sum(nil), want) {
+			return false, nil
+		}
+		found = true
+	}
+	return found, nil
+}
+
+func verifySignatureFile(sf, manifest []byte) error {
+	sfSections := parseManifest(sf)
+	if len(sfSections) == 0 {
+		return errors.New("empty signature file")
+	}
+	ok, err := checkDigests(sfSections[0].attrs, "-Digest-Manifest", manifest)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+	// The digest over the whole manifest is optional or may be stale;
+	// fall back to the per-entry digests of the manifest sections.
+	mfSections := parseManifest(manifest)
+	if len(mfSections) == 0 {
+		return errors.New("empty manifest")
+	}
+	byName := make(map[string]manifestSection, len(mfSections))
+	for _, s := range mfSections[1:] {
+		byName[s.attrs["Name"]] = s
+	}
+	for _, s := range sfSections[1:] {
+		name := s.attrs["Name"]
+		mf, e := byName[name]
+		if !e {
+			return fmt.Errorf("signature file lists %s, missing from manifest", name)
+		}
+		ok, err := checkDigests(s.attrs, "-Digest", mf.raw)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("manifest digest mismatch for %s", name)
+		}
+		delete(byName, name)
+	}
+	if len(byName) > 0 {
+		return errors.New("manifest has unsigned entries")
+	}
+	return nil
+}
+
+func verifyManifest(manifest []byte, files []*zip.File) error {
+	sections := parseManifest(manifest)
+	byName := make(map[string]manifestSection, len(sections))
+	for _, s := range sections {
+		if name, ok := s.attrs["Name"]; ok {
+			byName[name] = s
+		}
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name, "META-INF/") || strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		s, e := byName[f.Name]
+		if !e {
+			return fmt.Errorf("%s is not signed", f.Name)
+		}
+		data, err := readZipFile(f)
+		if err != nil {
+			return err
+		}
+		ok, err := checkDigests(s.attrs, "-Digest", data)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("digest mismatch for %s", f.Name)
+		}
+	}
+	return nil
+}
+
+// The PKCS#7 structures below only cover what is needed to verify the
+// SignedData blocks found in signed jars.
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue     `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue     `asn1:"optional,tag:1"`
+	SignerInfos      []pkcs7SignerInfo `asn1:"set"`
+}
+
+type pkcs7IssuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type pkcs7SignerInfo struct {
+	Version            int
+	IssuerAndSerial    pkcs7IssuerAndSerial
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	AuthAttributes     asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnauthAttributes   asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type pkcs7Attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+var (
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+
+	oidDigests = map[string]crypto.Hash{
+		"1.3.14.3.2.26":          crypto.SHA1,
+		"2.16.840.1.101.3.4.2.1": crypto.SHA256,
+		"2.16.840.1.101.3.4.2.2": crypto.SHA384,
+		"2.16.840.1.101.3.4.2.3": crypto.SHA512,
+	}
+)
+
+// verifyPKCS7 checks that block is a valid detached PKCS#7 signature over
+// content, returning the signing certificate.
+func verifyPKCS7(block, content []byte) (*x509.Certificate, error) {
+	var ci pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(block, &ci); err != nil {
+		return nil, err
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("unexpected content type %v", ci.ContentType)
+	}
+	var sd pkcs7SignedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, err
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if len(sd.SignerInfos) != 1 {
+		return nil, fmt.Errorf("expected one signer, found %d", len(sd.SignerInfos))
+	}
+	si := sd.SignerInfos[0]
+	var cert *x509.Certificate
+	for _, c := range certs {
+		if c.SerialNumber.Cmp(si.IssuerAndSerial.SerialNumber) == 0 &&
+			bytes.Equal(c.RawIssuer, si.IssuerAndSerial.Issuer.FullBytes) {
+			cert = c
+			break
+		}
+	}
+	if cert == nil {
+		return nil, errors.New("signing certificate not found")
+	}
+	hash, ok := oidDigests[si.DigestAlgorithm.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported digest algorithm %v", si.DigestAlgorithm.Algorithm)
+	}
+	h := hash.New()
+	h.Write(content)
+	digest := h.Sum(nil)
+
+	if len(si.AuthAttributes.Bytes) > 0 {
+		// With authenticated attributes, the content digest is one of
+		// the attributes, and the signature covers their DER encoding
+		// as a SET rather than with the implicit [0] tag.
+		var attrs []pkcs7Attribute
+		if _, err := asn1.UnmarshalWithParams(si.AuthAttributes.FullBytes, &attrs, "set,tag:0"); err != nil {
+			return nil, err
+		}
+		var msgDigest []byte
+		for _, attr := range attrs {
+			if attr.Type.Equal(oidMessageDigest) {
+				if _, err := asn1.Unmarshal(attr.Values.Bytes, &msgDigest); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if !bytes.Equal(msgDigest, digest) {
+			return nil, errors.New("content digest mismatch")
+		}
+		signed := append([]byte(nil), si.AuthAttributes.FullBytes...)
+		signed[0] = 0x31 // SET OF
+		h := hash.New()
+		h.Write(signed)
+		digest = h.Sum(nil)
+	}
+
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(pub, hash, digest, si.Signature)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest, si.Signature) {
+			err = errors.New("ecdsa verification failed")
+		}
+	default:
+		err = fmt.Errorf("unsupported public key type %T", pub)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -25,6 +26,7 @@ list of apps to install from standard input, like:
 	packageName,versionCode,versionName
 	foo.bar,120,1.2.0
 `[1:],
+	Mutates: true,
 }
 
 var (
@@ -37,12 +39,24 @@ var (
 	USER_ID: installs app for USER_ID; upgrades only apps of USER_ID and installs the new version only for USER_ID
 	current: installs app for the current user; upgrades only apps of the current user and installs the new version only for the current user
 	all: installs app for all users; upgrades apps of all users and installs the new version for all users`)
+	installDevices = deviceFlags(&cmdInstall.Fset)
+	installJobs    = cmdInstall.Fset.Int("j", 4, "Number of APKs to download at once")
 )
 
 func init() {
 	cmdInstall.Run = runInstall
 }
 
+// installPlan holds what is to be installed on a device.
+type installPlan struct {
+	device    *adb.Device
+	installed map[string]adb.Package
+	// user is the resolved value of -user for the device.
+	user string
+	apps []fdroid.App
+	apks []*fdroid.Apk
+}
+
 func runInstall(args []string) error {
 	if *installUpdates && len(args) > 0 {
 		return fmt.Errorf("-u can only be used without arguments")
@@ -50,51 +64,102 @@ func runInstall(args []string) error {
 	if *installUpdatesExclude != "" && !*installUpdates {
 		return fmt.Errorf("-e can only be used for upgrading (i.e. -u)")
 	}
-	device, err := oneDevice()
+	if *installJobs < 1 {
+		return fmt.Errorf("-j must be at least 1")
+	}
+	devices, err := installDevices.devices()
 	if err != nil {
 		return err
 	}
+
+	var apps []fdroid.App
+	if *installUpdates {
+		if apps, err = loadIndexes(); err != nil {
+			return err
+		}
+	} else {
+		if len(args) == 0 {
+			// The CSV input is as follows:
+			//
+			// packageName,versionCode,versionName
+			// foo.bar,120,1.2.0
+			// ...
+
+			r := csv.NewReader(os.Stdin)
+			r.FieldsPerRecord = 3
+			r.Read()
+			for {
+				record, err := r.Read()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return fmt.Errorf("error parsing CSV: %v", err)
+				}
+				// convert "foo.bar,120" into "foo.bar:120" for findApps
+				args = append(args, record[0]+":"+record[1])
+			}
+		}
+		if apps, err = findApps(args); err != nil {
+			return err
+		}
+	}
+
+	plans := make([]*installPlan, len(devices))
+	_, errs := forEachDevice(devices, func(i int, out *deviceOutput) (string, error) {
+		plan, err := planInstall(devices[i], out, apps)
+		plans[i] = plan
+		return "", err
+	})
+	if len(devices) == 1 && errs[0] != nil {
+		return errs[0]
+	}
+	// A device which couldn't be planned for is reported as failed in the
+	// summary, while the others go ahead.
+	return downloadAndDo(devices, plans, errs)
+}
+
+// planInstall decides which apps and APKs are to be installed on a device.
+func planInstall(device *adb.Device, out *deviceOutput, apps []fdroid.App) (*installPlan, error) {
 	inst, err := device.Installed()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if *installUser != "" && *installUser != "all" && *installUser != "current" {
-		n, err := strconv.Atoi(*installUser)
+	user := *installUser
+	if user != "" && user != "all" && user != "current" {
+		n, err := strconv.Atoi(user)
 		if err != nil {
-			return fmt.Errorf("-user has to be <USER_ID|current|all>")
+			return nil, fmt.Errorf("-user has to be <USER_ID|current|all>")
 		}
 		if n < 0 {
-			return fmt.Errorf("-user cannot have a negative number as USER_ID")
+			return nil, fmt.Errorf("-user cannot have a negative number as USER_ID")
 		}
 		allUids := adb.AllUserIds(inst)
 		if _, exists := allUids[n]; !exists {
-			return fmt.Errorf("user %d does not exist", n)
+			return nil, fmt.Errorf("user %d does not exist", n)
 		}
 	}
-	if *installUser == "current" || (*installUser == "" && !*installUpdates) {
+	if user == "current" || (user == "" && !*installUpdates) {
 		uid, err := device.CurrentUserId()
 		if err != nil {
-			return err
+			return nil, err
 		}
-		*installUser = strconv.Itoa(uid)
+		user = strconv.Itoa(uid)
 	}
+	plan := &installPlan{device: device, installed: inst, user: user}
 
 	if *installUpdates {
-		apps, err := loadIndexes()
-		if err != nil {
-			return err
-		}
 		var filterUser *int
-		if *installUser == "all" || *installUser == "" {
+		if user == "all" || user == "" {
 			filterUser = nil
 		} else {
-			n, err := strconv.Atoi(*installUser)
+			n, err := strconv.Atoi(user)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			filterUser = &n
 		}
-		apps = filterAppsUpdates(apps, inst, device, filterUser)
+		apps = filterAppsUpdates(apps, inst, device, out, filterUser)
 		if *installUpdatesExclude != "" {
 			excludeApps := strings.Split(*installUpdatesExclude, ",")
 			installApps := make([]fdroid.App, 0)
@@ -114,38 +179,11 @@ func runInstall(args []string) error {
 			apps = installApps
 		}
 		if len(apps) == 0 {
-			fmt.Fprintln(os.Stderr, "All apps up to date.")
+			out.Fprintf(os.Stderr, "All apps up to date.\n")
 		}
-		return downloadAndDo(apps, inst, device)
+		return plan, plan.addApks(apps)
 	}
 
-	if len(args) == 0 {
-		// The CSV input is as follows:
-		//
-		// packageName,versionCode,versionName
-		// foo.bar,120,1.2.0
-		// ...
-
-		r := csv.NewReader(os.Stdin)
-		r.FieldsPerRecord = 3
-		r.Read()
-		for {
-			record, err := r.Read()
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				return fmt.Errorf("error parsing CSV: %v", err)
-			}
-			// convert "foo.bar,120" into "foo.bar:120" for findApps
-			args = append(args, record[0]+":"+record[1])
-		}
-	}
-
-	apps, err := findApps(args)
-	if err != nil {
-		return err
-	}
 	var toInstall []fdroid.App
 	for _, app := range apps {
 		p, e := inst[app.PackageName]
@@ -156,15 +194,15 @@ func runInstall(args []string) error {
 		}
 		suggested := app.SuggestedApk(device)
 		if suggested == nil {
-			return fmt.Errorf("no suitable APKs found for %s", app.PackageName)
+			return nil, fmt.Errorf("no suitable APKs found for %s", app.PackageName)
 		}
 		if p.VersCode >= suggested.VersCode {
-			if !(*installUser == "all" && len(p.NotInstalledForUsers) > 0) { // ensure that it can't install for other user
-				okSkip := *installUser == "all"
+			if !(user == "all" && len(p.NotInstalledForUsers) > 0) { // ensure that it can't install for other user
+				okSkip := user == "all"
 				if !okSkip {
-					n, err := strconv.Atoi(*installUser)
+					n, err := strconv.Atoi(user)
 					if err != nil {
-						return err
+						return nil, err
 					}
 					isInstalledForUser := false
 					for _, uid := range p.InstalledForUsers {
@@ -178,7 +216,7 @@ func runInstall(args []string) error {
 					}
 				}
 				if okSkip {
-					fmt.Printf("%s is up to date\n", app.PackageName)
+					out.Printf("%s is up to date\n", app.PackageName)
 					// app is already up to date
 					continue
 				}
@@ -187,59 +225,100 @@ func runInstall(args []string) error {
 		// upgrading an existing app
 		toInstall = append(toInstall, app)
 	}
-	return downloadAndDo(toInstall, inst, device)
+	return plan, plan.addApks(toInstall)
 }
 
-func downloadAndDo(apps []fdroid.App, installed map[string]adb.Package, device *adb.Device) error {
-	type downloaded struct {
-		apk  *fdroid.Apk
-		app  fdroid.App
-		path string
-	}
-	toInstall := make([]downloaded, 0)
+// addApks selects the APK to install for each of the apps, depending on the
+// device's ABIs and API level.
+func (p *installPlan) addApks(apps []fdroid.App) error {
 	for _, app := range apps {
-		apk := app.SuggestedApk(device)
+		apk := app.SuggestedApk(p.device)
 		if apk == nil {
 			return fmt.Errorf("no suitable APKs found for %s", app.PackageName)
 		}
-		if *installDryRun {
-			fmt.Printf("install %s:%d\n", app.PackageName, apk.VersCode)
-			continue
-		}
-		path, err := downloadApk(apk)
-		if err != nil {
-			if *installSkipError {
-				fmt.Printf("Downloading %s failed, skipping...\n", app.PackageName)
+		p.apps = append(p.apps, app)
+		p.apks = append(p.apks, apk)
+	}
+	return nil
+}
+
+func downloadAndDo(devices []*adb.Device, plans []*installPlan, planErrs []error) error {
+	multiple := len(plans) > 1
+	if *installDryRun {
+		results := make([]string, len(plans))
+		for i, plan := range plans {
+			if planErrs[i] != nil {
 				continue
 			}
-			return err
+			out := newDeviceOutput(plan.device, multiple)
+			for j, app := range plan.apps {
+				out.Printf("install %s:%d\n", app.PackageName, plan.apks[j].VersCode)
+			}
+			results[i] = fmt.Sprintf("%d to install", len(plan.apps))
 		}
-		toInstall = append(toInstall, downloaded{apk: apk, app: app, path: path})
-	}
-	if *installDryRun {
-		return nil
+		return deviceSummary(devices, results, planErrs)
 	}
-	for _, t := range toInstall {
-		var installedPkg *adb.Package = nil
-		if p, e := installed[t.app.PackageName]; e {
-			installedPkg = &p
+	// Download each APK once, even if it's to be installed on many devices.
+	// Installs start as soon as each of their APKs is ready.
+	downloads := make(map[string]*apkDownload)
+	var queue []*apkDownload
+	for i, plan := range plans {
+		if planErrs[i] != nil {
+			continue
 		}
-		if err := installApk(device, t.apk, installedPkg, t.path); err != nil {
-			if *installSkipError {
-				fmt.Printf("Installing %s failed, skipping...\n", t.apk.AppID)
-				continue
+		for _, apk := range plan.apks {
+			path := apkPath(apk.ApkName)
+			if _, ok := downloads[path]; !ok {
+				d := newApkDownload(apk)
+				downloads[path] = d
+				queue = append(queue, d)
 			}
-			return err
 		}
 	}
-	return nil
+	stopBars := startBars()
+	go downloadApks(queue, *installJobs, *installSkipError)
+	results, errs := forEachDevice(devices, func(i int, out *deviceOutput) (string, error) {
+		if planErrs[i] != nil {
+			return "", planErrs[i]
+		}
+		plan := plans[i]
+		installed, skipped := 0, 0
+		for i, apk := range plan.apks {
+			d := downloads[apkPath(apk.ApkName)]
+			<-d.done
+			if d.err != nil {
+				if *installSkipError {
+					out.Printf("Downloading %s failed, skipping...\n", apk.AppID)
+					skipped++
+					continue
+				}
+				return "", d.err
+			}
+			var installedPkg *adb.Package = nil
+			if p, e := plan.installed[plan.apps[i].PackageName]; e {
+				installedPkg = &p
+			}
+			if err := installApk(plan, out, apk, installedPkg, d.path); err != nil {
+				if *installSkipError {
+					out.Printf("Installing %s failed, skipping...\n", apk.AppID)
+					skipped++
+					continue
+				}
+				return "", err
+			}
+			installed++
+		}
+		return fmt.Sprintf("%d installed, %d skipped", installed, skipped), nil
+	})
+	stopBars()
+	return deviceSummary(devices, results, errs)
 }
 
-func installApk(device *adb.Device, apk *fdroid.Apk, devicePkg *adb.Package, path string) error {
-	fmt.Printf("Installing %s\n", apk.AppID)
+func installApk(plan *installPlan, out *deviceOutput, apk *fdroid.Apk, devicePkg *adb.Package, path string) error {
+	out.Printf("Installing %s\n", apk.AppID)
 	userId := "all"
-	if *installUser != "all" {
-		if *installUpdates && *installUser == "" {
+	if plan.user != "all" {
+		if *installUpdates && plan.user == "" {
 			if devicePkg == nil {
 				return fmt.Errorf("failed to get device package although it should be installed (please report this error)")
 			}
@@ -247,17 +326,19 @@ func installApk(device *adb.Device, apk *fdroid.Apk, devicePkg *adb.Package, pat
 				userId = strconv.Itoa((*devicePkg).InstalledForUsers[0])
 			}
 		} else {
-			userId = *installUser
+			userId = plan.user
 		}
 	}
 	if userId == "all" {
-		if err := device.Install(path); err != nil {
-			return fmt.Errorf("could not install %s: %v", apk.AppID, err)
-		}
-	} else {
-		if err := device.InstallUser(path, userId); err != nil {
-			return fmt.Errorf("could not install %s: %v", apk.AppID, err)
-		}
+		userId = ""
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	progress := newProgressBar(info.Size(), out.prefix+"Sending "+filepath.Base(path))
+	if err := plan.device.InstallProgress(path, userId, progress); err != nil {
+		return fmt.Errorf("could not install %s: %v", apk.AppID, err)
 	}
 	return nil
 }
@@ -9,6 +9,7 @@ import (
 	"os"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -38,9 +39,7 @@ func runList(args []string) error {
 			}
 		}
 	case "users":
-		if err := listUsers(); err != nil {
-			return err
-		}
+		return listUsers()
 	default:
 		return fmt.Errorf("invalid argument")
 	}
@@ -49,6 +48,9 @@ func runList(args []string) error {
 		result = append(result, s)
 	}
 	sort.Strings(result)
+	if *jsonOutput {
+		return printJSON(result)
+	}
 	for _, s := range result {
 		fmt.Fprintln(os.Stdout, s)
 	}
@@ -62,14 +64,11 @@ func listUsers() error {
 	if err != nil {
 		return err
 	}
-	cmd := device.AdbShell("pm", "list", "users")
-	stdout, err := cmd.StdoutPipe()
+	stdout, err := device.AdbShell("pm", "list", "users")
 	if err != nil {
 		return err
 	}
-	if err := cmd.Start(); err != nil {
-		return err
-	}
+	defer stdout.Close()
 	uidHeader := "UID"
 	nameHeader := "Name"
 	runningHeader := "Running"
@@ -101,6 +100,14 @@ func listUsers() error {
 		}
 		running = append(running, currentRunning)
 	}
+	if *jsonOutput {
+		list := make([]jsonUser, len(uids))
+		for i, uid := range uids {
+			id, _ := strconv.Atoi(uid)
+			list[i] = jsonUser{ID: id, Name: names[i], Running: running[i]}
+		}
+		return printJSON(list)
+	}
 	if len(uids) == 0 {
 		return nil
 	}
@@ -0,0 +1,89 @@
+// Copyright (c) 2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// errLocked is returned by lockFile when another process holds the lock.
+var errLocked = errors.New("locked")
+
+// lockDirs takes the lock files in the data and cache directories, so that
+// commands which modify them cannot run concurrently. If wait is false and
+// another fdroidcl process holds either lock, an error is returned instead of
+// waiting for it to finish.
+//
+// The locks are advisory, and are released when the returned func is called
+// or the process exits.
+func lockDirs(wait bool) (unlock func(), err error) {
+	var files []*os.File
+	unlock = func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	// Always lock in the same order, so that two waiting processes can't
+	// deadlock. Both directories may be the same, such as on Windows, and
+	// a lock file must only be locked once.
+	dirs := []string{mustData()}
+	if cache := mustCache(); filepath.Clean(cache) != filepath.Clean(dirs[0]) {
+		dirs = append(dirs, cache)
+	}
+	for _, dir := range dirs {
+		f, err := lockDir(dir, wait)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return unlock, nil
+}
+
+func lockDir(dir string, wait bool) (*os.File, error) {
+	path := filepath.Join(dir, "lock")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open lock file: %v", err)
+	}
+	err = lockFile(f, false)
+	if err == errLocked {
+		pid := ""
+		if n := lockPid(f); n > 0 {
+			pid = fmt.Sprintf(" (pid %d)", n)
+		}
+		if !wait {
+			f.Close()
+			return nil, fmt.Errorf("another %s is running%s; use -wait to wait for it", cmdName, pid)
+		}
+		fmt.Fprintf(os.Stderr, "Waiting for another %s%s to finish...\n", cmdName, pid)
+		err = lockFile(f, true)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not lock %s: %v", path, err)
+	}
+	// Record who holds the lock, for the benefit of other processes.
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return f, nil
+}
+
+// lockPid returns the process ID recorded in a lock file, or 0 if unknown.
+func lockPid(f *os.File) int {
+	b, err := io.ReadAll(io.NewSectionReader(f, 0, 32))
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	return pid
+}
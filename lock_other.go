@@ -0,0 +1,13 @@
+// Copyright (c) 2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package main
+
+import "os"
+
+// lockFile is a no-op on systems without flock.
+func lockFile(f *os.File, wait bool) error {
+	return nil
+}
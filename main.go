@@ -4,7 +4,6 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
@@ -50,43 +49,72 @@ type repo struct {
 	ID      string `json:"id"`
 	URL     string `json:"url"`
 	Enabled bool   `json:"enabled"`
+
+	// Fingerprint is the hex-encoded SHA-256 fingerprint of the
+	// certificate that signs the repository index. If set, the index is
+	// rejected unless it is signed by that certificate.
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	// Mirrors lists other base URLs serving the same repository, which
+	// are tried in order if URL fails. The mirrors listed by the index
+	// itself are tried last.
+	Mirrors []string `json:"mirrors,omitempty"`
+
+	// Auth and Headers are used for all requests to the repository's URL
+	// and mirrors above, and nowhere else.
+	Auth    *repoAuth         `json:"auth,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
 }
 
+// fdroidFingerprint is the fingerprint of the key that signs the official
+// f-droid.org repositories.
+const fdroidFingerprint = "43238d512c1e5eb2d6569f4a3afbf5523418b82e0a3ed1552770abb9a9c9ccab"
+
 type userConfig struct {
+	// Version is the layout version of the config file, which is migrated
+	// from older versions when read. See configVersion.
+	Version int `json:"version"`
+
 	Repos []repo `json:"repos"`
+
+	// PinnedRepos maps package names to the ID of the only repo whose
+	// APKs may be suggested for them, such as when other repos publish
+	// the same app signed with a different key.
+	PinnedRepos map[string]string `json:"pinnedRepos,omitempty"`
+
+	// Proxy is the URL of the proxy to use for all downloads, overridden by
+	// the -proxy flag. See setupProxy.
+	Proxy string `json:"proxy,omitempty"`
+
+	// ConnectTimeout, IdleTimeout and RetryDelay are durations such as
+	// "30s", and Retries is how many times to retry failed downloads. See
+	// setupRetries.
+	ConnectTimeout string `json:"connectTimeout,omitempty"`
+	IdleTimeout    string `json:"idleTimeout,omitempty"`
+	RetryDelay     string `json:"retryDelay,omitempty"`
+	Retries        *int   `json:"retries,omitempty"`
 }
 
 var config = userConfig{
+	Version: configVersion,
 	Repos: []repo{
 		{
 			ID:      "f-droid",
 			URL:     "https://f-droid.org/repo",
 			Enabled: true,
+
+			Fingerprint: fdroidFingerprint,
 		},
 		{
 			ID:      "f-droid-archive",
 			URL:     "https://f-droid.org/archive",
 			Enabled: false,
+
+			Fingerprint: fdroidFingerprint,
 		},
 	},
 }
 
-func readConfig() error {
-	f, err := os.Open(configPath())
-	if err != nil {
-		// ignore error, if file does not exist
-		return nil
-	}
-	defer f.Close()
-	fileConfig := userConfig{}
-	err = json.NewDecoder(f).Decode(&fileConfig)
-	if err != nil {
-		return err
-	}
-	config = fileConfig
-	return nil
-}
-
 // A Command is an implementation of a go command
 // like go build or go fix.
 type Command struct {
@@ -104,6 +132,14 @@ type Command struct {
 	// Long is an optional longer version of the Short description.
 	Long string
 
+	// Mutates is set for commands which modify the config, data or cache
+	// directories. They are not run concurrently with each other.
+	Mutates bool
+
+	// ReadOnly, if set, reports whether a command which Mutates only reads
+	// when given args, so that it can run concurrently with others.
+	ReadOnly func(args []string) bool
+
 	Fset flag.FlagSet
 }
 
@@ -134,7 +170,7 @@ func (c *Command) usage() {
 
 func init() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "usage: %s [-h] <command> [<args>]\n\n", cmdName)
+		fmt.Fprintf(os.Stderr, "usage: %s [-h] [-json] [-proxy <url>] <command> [<args>]\n\n", cmdName)
 		fmt.Fprintf(os.Stderr, "Available commands:\n")
 		maxUsageLen := 0
 		for _, c := range commands {
@@ -172,6 +208,7 @@ var commands = []*Command{
 	cmdRepo,
 	cmdClean,
 	cmdDefaults,
+	cmdConfig,
 	cmdVersion,
 }
 
@@ -187,6 +224,8 @@ var cmdVersion = &Command{
 	},
 }
 
+var jsonOutput = flag.Bool("json", false, "Print JSON documents instead of text")
+
 func main() {
 	os.Exit(main1())
 }
@@ -207,6 +246,9 @@ func main1() int {
 		}
 		cmd.Fset.Init(cmdName, flag.ContinueOnError)
 		cmd.Fset.Usage = cmd.usage
+		if cmd.Mutates && cmd.Fset.Lookup("wait") == nil {
+			cmd.Fset.Bool("wait", false, "Wait for other running commands to finish instead of failing")
+		}
 		if err := cmd.Fset.Parse(args[1:]); err != nil {
 			if err != flag.ErrHelp {
 				fmt.Fprintf(os.Stderr, "flag: %v\n", err)
@@ -215,11 +257,29 @@ func main1() int {
 			return 2
 		}
 
+		if cmd.Mutates && (cmd.ReadOnly == nil || !cmd.ReadOnly(cmd.Fset.Args())) {
+			wait := cmd.Fset.Lookup("wait").Value.(flag.Getter).Get().(bool)
+			unlock, err := lockDirs(wait)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", cmdName, err)
+				return 1
+			}
+			defer unlock()
+		}
+
 		err := readConfig()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "config %s: %v\n", configPath(), err)
 			return 1
 		}
+		err = setupProxy()
+		if err == nil {
+			err = setupRetries()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", cmdName, err)
+			return 1
+		}
 
 		if err := cmd.Run(cmd.Fset.Args()); err != nil {
 			fmt.Fprintf(os.Stderr, "%s: %v\n", cmdName, err)
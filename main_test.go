@@ -1,27 +1,97 @@
 package main
 
 import (
+	"bufio"
+	"encoding/base64"
+	"flag"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/rogpeppe/go-internal/testscript"
 	"mvdan.cc/fdroidcl/adb"
 )
 
 func TestMain(m *testing.M) {
-	if os.Getenv("TESTSCRIPT_COMMAND") == "" {
+	// REPO_HOST is only set for the fdroidcl commands run by the scripts.
+	if os.Getenv("REPO_HOST") == "" {
 		// start the static http server once
 		path := filepath.Join("testdata", "staticrepo")
 		fs := http.FileServer(http.Dir(path))
+		var mu sync.Mutex
+		hits := make(map[string]int)
 		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			// The files are static, so add a unique etag for each file.
 			w.Header().Set("Etag", strconv.Quote(r.URL.Path))
+			mu.Lock()
+			hits[r.URL.Path]++
+			n := hits[r.URL.Path]
+			mu.Unlock()
+
+			// Paths under /private/ need credentials, and those under
+			// /public/ must never get them.
+			if p := strings.TrimPrefix(r.URL.Path, "/private"); p != r.URL.Path {
+				user, pass, _ := r.BasicAuth()
+				if (user != "user" || pass != "secret") && r.Header.Get("Authorization") != "Bearer t0ken" ||
+					r.Header.Get("X-Repo-Key") != "k" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				if rest := strings.TrimPrefix(p, "/redirect"); rest != p {
+					http.Redirect(w, r, "https://elsewhere.example/public"+rest, http.StatusFound)
+					return
+				}
+				r.URL.Path = p
+			} else if p := strings.TrimPrefix(r.URL.Path, "/public"); p != r.URL.Path {
+				if r.Header.Get("Authorization") != "" || r.Header.Get("X-Repo-Key") != "" {
+					http.Error(w, "credentials leaked", http.StatusBadRequest)
+					return
+				}
+				r.URL.Path = p
+			}
+
+			// Paths under /live/ serve the directory chosen by the
+			// live command, so that a repo can move on.
+			if p := strings.TrimPrefix(r.URL.Path, "/live"); p != r.URL.Path {
+				liveMu.Lock()
+				r.URL.Path = "/" + liveDir + p
+				missing := liveMissing[strings.TrimPrefix(p, "/")]
+				liveMu.Unlock()
+				if missing {
+					http.NotFound(w, r)
+					return
+				}
+				w.Header().Set("Etag", strconv.Quote(r.URL.Path))
+			}
+
+			// Paths under /flaky/ and /stall/ simulate failures the
+			// first times that each file is requested.
+			if p := strings.TrimPrefix(r.URL.Path, "/flaky"); p != r.URL.Path {
+				r.URL.Path = p
+				switch n {
+				case 1:
+					w.Header().Set("Retry-After", "1")
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				case 2:
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+			} else if p := strings.TrimPrefix(r.URL.Path, "/stall"); p != r.URL.Path {
+				r.URL.Path = p
+				if n == 1 {
+					stallHalfway(w, r, filepath.Join(path, filepath.FromSlash(p)))
+					return
+				}
+			}
 			fs.ServeHTTP(w, r)
 		})
 		ln, err := net.Listen("tcp", ":0")
@@ -33,8 +103,32 @@ func TestMain(m *testing.M) {
 		// Save it to a global, which will be added as an env var to be
 		// picked up by the children processes.
 		staticRepoHost = ln.Addr().String()
+
+		// Also start a forward proxy which requires credentials.
+		ln, err = net.Listen("tcp", ":0")
+		if err != nil {
+			panic(err)
+		}
+		go http.Serve(ln, http.HandlerFunc(proxyHandler))
+		proxyHost = ln.Addr().String()
+
+		// And a fake ADB server with two devices.
+		ln, err = net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			panic(err)
+		}
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go serveFakeAdb(c)
+			}
+		}()
+		fakeAdbHost = ln.Addr().String()
 	} else {
-		httpClient.Transport = repoTransport{os.Getenv("REPO_HOST")}
+		baseTransport = repoTransport{os.Getenv("REPO_HOST")}
 	}
 
 	os.Exit(testscript.RunMain(m, map[string]func() int{
@@ -50,16 +144,207 @@ func (t repoTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	// replace https://f-droid.org/repo/foo with http://localhost:1234/foo
 	req.URL.Scheme = "http"
 	req.URL.Host = t.repoHost
+	req.Host = ""
 	req.URL.Path = strings.TrimPrefix(req.URL.Path, "/repo")
-	return http.DefaultClient.Do(req)
+	return httpTransport.RoundTrip(req)
+}
+
+var staticRepoHost, proxyHost, fakeAdbHost string
+
+var (
+	liveMu      sync.Mutex
+	liveDir     = "v2"
+	liveMissing map[string]bool
+)
+
+// cmdLive sets the directory of the static repo served under /live/, and
+// which of its files are missing.
+func cmdLive(ts *testscript.TestScript, neg bool, args []string) {
+	if neg || len(args) < 1 {
+		ts.Fatalf("usage: live dir [missing files...]")
+	}
+	liveMu.Lock()
+	liveDir = args[0]
+	liveMissing = make(map[string]bool)
+	for _, name := range args[1:] {
+		liveMissing[name] = true
+	}
+	liveMu.Unlock()
+}
+
+// stallHalfway sends half of a file, and then stalls until the client gives
+// up.
+func stallHalfway(w http.ResponseWriter, r *http.Request, path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data[:len(data)/2])
+	w.(http.Flusher).Flush()
+	select {
+	case <-r.Context().Done():
+	case <-time.After(10 * time.Second):
+	}
+}
+
+// proxyHandler is a plain HTTP forward proxy, accepting the credentials
+// user:secret.
+func proxyHandler(w http.ResponseWriter, r *http.Request) {
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	if r.Header.Get("Proxy-Authorization") != want {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+	r.RequestURI = ""
+	r.Header.Del("Proxy-Authorization")
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Via", "testproxy")
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// fakeDevices are the devices of the fake ADB server. Both have an old
+// version of red_screen installed, and the second one fails to install or
+// uninstall any app.
+var fakeDevices = []struct {
+	id, model string
+	fail      bool
+}{
+	{"emulator-5554", "Pixel_3", false},
+	{"emulator-5556", "Pixel_4", true},
+}
+
+// fakeAdbMeet is used by the installs and uninstalls on the two fake devices
+// to wait for each other, so that they only succeed if done concurrently.
+var fakeAdbMeet = make(chan struct{})
+
+// serveFakeAdb serves a connection to the fake ADB server, which supports
+// listing the devices and running the few commands that fdroidcl uses.
+func serveFakeAdb(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	readRequest := func() string {
+		hexLen := make([]byte, 4)
+		if _, err := io.ReadFull(r, hexLen); err != nil {
+			return ""
+		}
+		n, err := strconv.ParseUint(string(hexLen), 16, 16)
+		if err != nil {
+			return ""
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return ""
+		}
+		return string(buf)
+	}
+	fail := func(msg string) {
+		fmt.Fprintf(c, "FAIL%04x%s", len(msg), msg)
+	}
+
+	req := readRequest()
+	if req == "host:devices-l" {
+		var list strings.Builder
+		for _, d := range fakeDevices {
+			fmt.Fprintf(&list, "%s device product:sdk_phone model:%s device:generic transport_id:1\n", d.id, d.model)
+		}
+		fmt.Fprintf(c, "OKAY%04x%s", list.Len(), list.String())
+		return
+	}
+	serial := strings.TrimPrefix(req, "host:transport:")
+	if serial == req {
+		fail("unknown request " + req)
+		return
+	}
+	i := 0
+	for i < len(fakeDevices) && fakeDevices[i].id != serial {
+		i++
+	}
+	if i == len(fakeDevices) {
+		fail("device '" + serial + "' not found")
+		return
+	}
+	failing := fakeDevices[i].fail
+	io.WriteString(c, "OKAY")
+
+	req = readRequest()
+	cmd := strings.TrimPrefix(strings.TrimPrefix(req, "shell:"), "exec:")
+	if cmd == req {
+		fail("unknown service " + req)
+		return
+	}
+	io.WriteString(c, "OKAY")
+	switch args := strings.Fields(cmd); {
+	case cmd == "getprop":
+		io.WriteString(c, "[ro.build.version.sdk]: [30]\r\n[ro.product.cpu.abilist]: [x86_64,arm64-v8a]\r\n")
+	case cmd == "dumpsys package packages":
+		io.WriteString(c, "Packages:\r\n"+
+			"  Package [org.vi_server.red_screen] (1a2b3c):\r\n"+
+			"    versionCode=1 minSdk=9 targetSdk=17\r\n"+
+			"    versionName=1.0\r\n"+
+			"    User 0: ceDataInode=1 installed=true hidden=false\r\n")
+	case cmd == "dumpsys activity":
+		io.WriteString(c, "  mUserLru: [0]\r\n")
+	case len(args) > 2 && args[0] == "cmd" && args[1] == "package" && args[2] == "install":
+		size, _ := strconv.ParseInt(args[len(args)-1], 10, 64)
+		if _, err := io.CopyN(io.Discard, r, size); err != nil {
+			return
+		}
+		if meetFakeDevice(failing) && !failing {
+			io.WriteString(c, "Success\r\n")
+		} else {
+			io.WriteString(c, "Failure [INSTALL_FAILED_INSUFFICIENT_STORAGE]\r\n")
+		}
+	case len(args) > 1 && args[0] == "pm" && args[1] == "uninstall":
+		if meetFakeDevice(failing) && !failing {
+			io.WriteString(c, "Success\r\n")
+		} else {
+			io.WriteString(c, "Failure [DELETE_FAILED_INTERNAL_ERROR]\r\n")
+		}
+	default:
+		fmt.Fprintf(c, "/system/bin/sh: %s: not found\r\n", cmd)
+	}
 }
 
-var staticRepoHost string
+// meetFakeDevice waits for the other fake device to be doing the same
+// operation, reporting whether it did in time.
+func meetFakeDevice(failing bool) bool {
+	if failing {
+		select {
+		case <-fakeAdbMeet:
+			return true
+		case <-time.After(10 * time.Second):
+			return false
+		}
+	}
+	select {
+	case fakeAdbMeet <- struct{}{}:
+		return true
+	case <-time.After(10 * time.Second):
+		return false
+	}
+}
+
+var update = flag.Bool("u", false, "update testscript output files")
 
 func TestScripts(t *testing.T) {
 	t.Parallel()
 	testscript.Run(t, testscript.Params{
-		Dir: filepath.Join("testdata", "scripts"),
+		Dir:           filepath.Join("testdata", "scripts"),
+		UpdateScripts: *update,
+		Cmds: map[string]func(ts *testscript.TestScript, neg bool, args []string){
+			"live": cmdLive,
+		},
 		Setup: func(e *testscript.Env) error {
 			home := e.WorkDir + "/home"
 			if err := os.MkdirAll(home, 0o777); err != nil {
@@ -69,6 +354,8 @@ func TestScripts(t *testing.T) {
 			e.Vars = append(e.Vars, "AppData="+home)
 			e.Vars = append(e.Vars, "LocalAppData="+home)
 			e.Vars = append(e.Vars, "REPO_HOST="+staticRepoHost)
+			e.Vars = append(e.Vars, "PROXY_HOST="+proxyHost)
+			e.Vars = append(e.Vars, "FAKE_ADB_SOCKET=tcp:"+fakeAdbHost)
 			return nil
 		},
 		Condition: func(cond string) (bool, error) {
@@ -0,0 +1,125 @@
+// Copyright (c) 2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+
+	"mvdan.cc/fdroidcl/fdroid"
+)
+
+// mirrors returns the base URLs that the repo can be downloaded from, in
+// order of preference: the one that worked last, the repo URL, the mirrors
+// in the config, and then extra, such as the mirrors listed by its index.
+func (r *repo) mirrors(st *repoState, extra ...string) []string {
+	var list []string
+	seen := make(map[string]bool)
+	add := func(urls ...string) {
+		for _, url := range urls {
+			url = strings.TrimRight(url, "/")
+			if url != "" && !seen[url] {
+				seen[url] = true
+				list = append(list, url)
+			}
+		}
+	}
+	// Only trust the last working mirror if it's still a known one.
+	all := append(append([]string{r.URL}, r.Mirrors...), extra...)
+	for _, url := range all {
+		if strings.TrimRight(url, "/") == st.Mirror {
+			add(st.Mirror)
+		}
+	}
+	add(all...)
+	return list
+}
+
+// indexMirrors returns the mirrors listed by the repo's index downloaded
+// before, if any.
+func (r *repo) indexMirrors() []string {
+	repo, err := r.indexRepo()
+	if err != nil {
+		return nil
+	}
+	return repo.Mirrors
+}
+
+// indexRepo returns the repository metadata from the repo's index downloaded
+// before, without loading the rest of the index.
+func (r *repo) indexRepo() (*fdroid.Repo, error) {
+	if f, err := os.Open(indexV2Path(r.ID)); err == nil {
+		defer f.Close()
+		return fdroid.LoadIndexV2RepoJSON(f)
+	}
+	f, err := os.Open(indexPath(r.ID))
+	if os.IsNotExist(err) {
+		return nil, errNoIndex
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return fdroid.LoadIndexJarRepo(f, info.Size())
+}
+
+// download downloads a file from the repo like downloadEtag, with name being
+// relative to the repo URL. Each of the repo's mirrors is tried in turn, and
+// the one that works is remembered in st.
+//
+// If optional is set, a "not found" error from a mirror is returned right
+// away, as it likely means that the repo doesn't publish the file at all.
+// A download refused by verify is treated like any other failure, so the
+// next mirror is tried.
+func (r *repo) download(name, target string, sum []byte, st *repoState, optional bool, verify func(path string) error) error {
+	base, err := downloadMirrors(r.mirrors(st, r.indexMirrors()...), name, target, sum, optional, verify)
+	if base != "" {
+		st.Mirror = base
+	}
+	return err
+}
+
+// failedMirrors holds the base URLs which failed during this run, to be
+// tried last from then on.
+var failedMirrors sync.Map
+
+// downloadMirrors downloads the file at name relative to each of the base
+// URLs in turn, until one of them works, and returns the base URL that was
+// used. If all of them fail, the error from the first one is returned.
+func downloadMirrors(bases []string, name, target string, sum []byte, optional bool, verify func(path string) error) (string, error) {
+	ordered := make([]string, 0, len(bases))
+	var failed []string
+	for _, base := range bases {
+		if _, ok := failedMirrors.Load(base); ok {
+			failed = append(failed, base)
+		} else {
+			ordered = append(ordered, base)
+		}
+	}
+	ordered = append(ordered, failed...)
+
+	var firstErr error
+	for i, base := range ordered {
+		url := base + "/" + strings.TrimPrefix(name, "/")
+		err := downloadEtag(url, target, sum, verify)
+		if err == nil || err == errNotModified {
+			return base, err
+		}
+		if optional && isNotFound(err) {
+			return "", err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		failedMirrors.Store(base, true)
+		if i+1 < len(ordered) {
+			lockedFprintf(os.Stderr, "warning: %v; trying the next mirror\n", err)
+		}
+	}
+	return "", firstErr
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"mvdan.cc/fdroidcl/adb"
+	"mvdan.cc/fdroidcl/fdroid"
+)
+
+// The types below define the documents printed with -json. They are kept
+// separate from the index and adb types so that the output stays stable
+// even if those change.
+
+type jsonVersion struct {
+	VersionName string `json:"versionName"`
+	VersionCode int    `json:"versionCode"`
+}
+
+type jsonInstalled struct {
+	jsonVersion
+	System bool  `json:"system"`
+	Users  []int `json:"users"`
+}
+
+type jsonApp struct {
+	PackageName string         `json:"packageName"`
+	Name        string         `json:"name"`
+	Summary     string         `json:"summary"`
+	Added       time.Time      `json:"added"`
+	LastUpdated time.Time      `json:"lastUpdated"`
+	Repo        string         `json:"repo"`
+	Suggested   *jsonVersion   `json:"suggested,omitempty"`
+	Installed   *jsonInstalled `json:"installed,omitempty"`
+	Device      string         `json:"device,omitempty"`
+}
+
+type jsonAppDetailed struct {
+	jsonApp
+	RepoURL      string    `json:"repoURL"`
+	PinnedRepo   string    `json:"pinnedRepo,omitempty"`
+	License      string    `json:"license"`
+	Categories   []string  `json:"categories"`
+	AntiFeatures []string  `json:"antiFeatures"`
+	Website      string    `json:"website,omitempty"`
+	SourceCode   string    `json:"sourceCode,omitempty"`
+	IssueTracker string    `json:"issueTracker,omitempty"`
+	Changelog    string    `json:"changelog,omitempty"`
+	Donate       string    `json:"donate,omitempty"`
+	Description  string    `json:"description"`
+	Apks         []jsonApk `json:"apks"`
+}
+
+type jsonApk struct {
+	jsonVersion
+	Added        time.Time        `json:"added"`
+	Size         int64            `json:"size"`
+	MinSdk       int              `json:"minSdk"`
+	MaxSdk       int              `json:"maxSdk,omitempty"`
+	TargetSdk    int              `json:"targetSdk"`
+	ABIs         []string         `json:"abis"`
+	Permissions  []jsonPermission `json:"permissions"`
+	AntiFeatures []string         `json:"antiFeatures"`
+	Repo         string           `json:"repo"`
+	URL          string           `json:"url"`
+	Hash         string           `json:"sha256"`
+}
+
+type jsonPermission struct {
+	Name   string `json:"name"`
+	MaxSdk int    `json:"maxSdk,omitempty"`
+}
+
+type jsonDevice struct {
+	Serial   string   `json:"serial"`
+	Model    string   `json:"model"`
+	Product  string   `json:"product"`
+	Device   string   `json:"device"`
+	ABIs     []string `json:"abis"`
+	APILevel int      `json:"apiLevel"`
+}
+
+type jsonUser struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Running bool   `json:"running"`
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "\t")
+	return enc.Encode(v)
+}
+
+// nonNil makes sure that empty lists are encoded as [] rather than null.
+func nonNil(l []string) []string {
+	if l == nil {
+		return []string{}
+	}
+	return l
+}
+
+func appJSON(app fdroid.App, inst *adb.Package, device *adb.Device) jsonApp {
+	ja := jsonApp{
+		PackageName: app.PackageName,
+		Name:        app.Name,
+		Summary:     app.Summary,
+		Added:       app.Added.Time,
+		LastUpdated: app.Updated.Time,
+		Repo:        app.FdroidRepoName,
+	}
+	if suggested := app.SuggestedApk(device); suggested != nil {
+		ja.Suggested = &jsonVersion{suggested.VersName, suggested.VersCode}
+	}
+	if device != nil {
+		ja.Device = device.ID
+	}
+	if inst != nil {
+		users := inst.InstalledForUsers
+		if users == nil {
+			users = []int{}
+		}
+		ja.Installed = &jsonInstalled{
+			jsonVersion: jsonVersion{inst.VersName, inst.VersCode},
+			System:      inst.IsSystem,
+			Users:       users,
+		}
+	}
+	return ja
+}
+
+func appsJSON(apps []fdroid.App, inst map[string]adb.Package, device *adb.Device) []jsonApp {
+	list := make([]jsonApp, 0, len(apps))
+	for _, app := range apps {
+		var pkg *adb.Package
+		if p, e := inst[app.PackageName]; e {
+			pkg = &p
+		}
+		list = append(list, appJSON(app, pkg, device))
+	}
+	return list
+}
+
+func appDetailedJSON(app fdroid.App) jsonAppDetailed {
+	var desc strings.Builder
+	app.TextDesc(&desc)
+	ja := jsonAppDetailed{
+		jsonApp:      appJSON(app, nil, nil),
+		RepoURL:      app.FdroidRepoURL,
+		PinnedRepo:   app.PinnedRepo,
+		License:      app.License,
+		Categories:   nonNil(app.Categories),
+		AntiFeatures: nonNil(app.AntiFeatures),
+		Website:      app.Website,
+		SourceCode:   app.SourceCode,
+		IssueTracker: app.IssueTracker,
+		Changelog:    app.Changelog,
+		Donate:       app.Donate,
+		Description:  strings.TrimSpace(desc.String()),
+		Apks:         make([]jsonApk, 0, len(app.Apks)),
+	}
+	for _, apk := range app.Apks {
+		perms := make([]jsonPermission, 0, len(apk.Perms))
+		for _, perm := range apk.Perms {
+			maxSdk, _ := strconv.Atoi(perm.MaxSdk)
+			perms = append(perms, jsonPermission{Name: perm.Name, MaxSdk: maxSdk})
+		}
+		ja.Apks = append(ja.Apks, jsonApk{
+			jsonVersion:  jsonVersion{apk.VersName, apk.VersCode},
+			Added:        apk.Added.Time,
+			Size:         apk.Size,
+			MinSdk:       apk.MinSdk.Value,
+			MaxSdk:       apk.MaxSdk.Value,
+			TargetSdk:    apk.TargetSdk.Value,
+			ABIs:         nonNil(apk.ABIs),
+			Permissions:  perms,
+			AntiFeatures: nonNil(apk.AntiFeatures),
+			Repo:         apk.RepoName,
+			URL:          apk.URL(),
+			Hash:         apk.Hash.String(),
+		})
+	}
+	return ja
+}
+
+func deviceJSON(device *adb.Device) jsonDevice {
+	return jsonDevice{
+		Serial:   device.ID,
+		Model:    device.Model,
+		Product:  device.Product,
+		Device:   device.Device,
+		ABIs:     nonNil(device.ABIs),
+		APILevel: device.APILevel,
+	}
+}
+
+// templateApp is what the -f templates are executed with. Suggested is nil if
+// no APK is suitable, and Installed is nil if the app is not installed or if
+// no device was used.
+type templateApp struct {
+	fdroid.App
+	Suggested *fdroid.Apk
+	Installed *adb.Package
+}
+
+func parseFormat(format string) (*template.Template, error) {
+	tmpl, err := template.New("format").Funcs(template.FuncMap{
+		"join": strings.Join,
+	}).Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -f template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// printFormat executes the template for each app, each followed by a newline.
+func printFormat(tmpl *template.Template, apps []fdroid.App, inst map[string]adb.Package, device *adb.Device) error {
+	w := bufio.NewWriter(os.Stdout)
+	for _, app := range apps {
+		ta := templateApp{App: app, Suggested: app.SuggestedApk(device)}
+		if p, e := inst[app.PackageName]; e {
+			ta.Installed = &p
+		}
+		if err := tmpl.Execute(w, ta); err != nil {
+			return err
+		}
+		w.WriteString("\n")
+	}
+	return w.Flush()
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// newProgressBar returns a progress bar for transferring size bytes, which may
+// be -1 if unknown. While a barStack is in use, the bar is added to it.
+func newProgressBar(size int64, description string) *progressbar.ProgressBar {
+	var w io.Writer = os.Stdout
+	onCompletion := func() { fmt.Fprint(os.Stdout, "\n") }
+	outputMu.Lock()
+	if bars != nil {
+		b := bars.add()
+		w, onCompletion = b, b.finish
+	}
+	outputMu.Unlock()
+	return progressbar.NewOptions64(
+		size,
+		progressbar.OptionSetDescription(description),
+		progressbar.OptionSetWriter(w),
+		progressbar.OptionShowBytes(true),
+		progressbar.OptionThrottle(50*time.Millisecond),
+		progressbar.OptionShowCount(),
+		progressbar.OptionOnCompletion(onCompletion),
+		progressbar.OptionSpinnerType(14),
+		progressbar.OptionSetRenderBlankState(true),
+		progressbar.OptionUseANSICodes(runtime.GOOS != "windows"),
+		progressbar.OptionFullWidth(),
+	)
+}
+
+// barStack shows many progress bars at once, one per line, below any other
+// output. On terminals, the bars are redrawn in place as they progress.
+// Otherwise, each bar is only printed once it's finished.
+type barStack struct {
+	ansi   bool
+	active []*stackedBar
+	// drawn is the number of bar lines currently on the terminal.
+	drawn int
+}
+
+type stackedBar struct {
+	stack *barStack
+	text  string
+	done  bool
+}
+
+// bars is the barStack in use, if any. Like the stack itself, it is guarded
+// by outputMu.
+var bars *barStack
+
+// startBars starts showing progress bars in a stack, until the returned func
+// is called.
+func startBars() (stop func()) {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	info, err := os.Stdout.Stat()
+	bars = &barStack{
+		ansi: err == nil && info.Mode()&os.ModeCharDevice != 0 && runtime.GOOS != "windows",
+	}
+	return func() {
+		outputMu.Lock()
+		defer outputMu.Unlock()
+		// Leave any unfinished bars as they were last drawn.
+		var lines []string
+		for _, b := range bars.active {
+			if b.text != "" {
+				lines = append(lines, b.text)
+			}
+		}
+		bars.active = nil
+		bars.flush(lines)
+		bars = nil
+	}
+}
+
+func (s *barStack) add() *stackedBar {
+	b := &stackedBar{stack: s}
+	s.active = append(s.active, b)
+	return b
+}
+
+// flush prints the given lines above the active bars, which are redrawn.
+func (s *barStack) flush(lines []string) {
+	if !s.ansi {
+		for _, line := range lines {
+			fmt.Fprintln(os.Stdout, line)
+		}
+		return
+	}
+	var sb strings.Builder
+	if s.drawn > 0 {
+		fmt.Fprintf(&sb, "\x1b[%dA", s.drawn)
+	}
+	for _, line := range lines {
+		fmt.Fprintf(&sb, "\r\x1b[2K%s\n", line)
+	}
+	drawn := 0
+	for _, b := range s.active {
+		if b.text != "" {
+			fmt.Fprintf(&sb, "\r\x1b[2K%s\n", b.text)
+			drawn++
+		}
+	}
+	// Clear the lines left over from before, if any.
+	if left := s.drawn - len(lines) - drawn; left > 0 {
+		sb.WriteString(strings.Repeat("\r\x1b[2K\n", left))
+		fmt.Fprintf(&sb, "\x1b[%dA", left)
+	}
+	s.drawn = drawn
+	io.WriteString(os.Stdout, sb.String())
+}
+
+// printLines prints text above the active bars.
+func (s *barStack) printLines(text string) {
+	s.flush(strings.Split(strings.TrimSuffix(text, "\n"), "\n"))
+}
+
+func (b *stackedBar) Write(p []byte) (int, error) {
+	text := strings.NewReplacer("\r", "", "\x1b[2K", "").Replace(string(p))
+	if strings.TrimSpace(text) == "" {
+		return len(p), nil
+	}
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	b.text = text
+	if b.stack.ansi && !b.done {
+		b.stack.flush(nil)
+	}
+	return len(p), nil
+}
+
+// finish stops redrawing the bar, leaving it printed above the active ones.
+func (b *stackedBar) finish() {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	if b.done {
+		return
+	}
+	b.done = true
+	s := b.stack
+	for i, b2 := range s.active {
+		if b2 == b {
+			s.active = append(s.active[:i], s.active[i+1:]...)
+			break
+		}
+	}
+	if b.text == "" {
+		s.flush(nil)
+		return
+	}
+	s.flush([]string{b.text})
+}
@@ -4,34 +4,116 @@
 package main
 
 import (
+	"archive/zip"
+	"encoding/hex"
 	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"mvdan.cc/fdroidcl/fdroid"
 )
 
 var cmdRepo = &Command{
 	UsageLine: "repo",
 	Short:     "Manage repositories",
 	Long: `
-List, add, remove, enable or disable repositories.
-When a repository is added, it is enabled by default.
+List, add, remove, enable, disable or reorder repositories.
+When a repository is added, its index is fetched right away, and it is
+enabled by default.
+
+The URL may also be a repository link as shared by F-Droid, such as
+"https://example.org/fdroid/repo?fingerprint=<FINGERPRINT>" or one starting
+with "fdroidrepos://", including the contents of a repository QR code. The
+fingerprint is then stored with the repository, and its index is only
+accepted if signed by the matching key.
+
+Repositories are listed in order of priority. When more than one of them
+provides an app, its details come from the first one, and when they provide
+APKs with the same version code, the ones from the first repository are
+preferred.
 
 List repositories:
 
 	$ fdroidcl repo
 
+Show the details of a repository and of its last downloaded index:
+
+	$ fdroidcl repo info <NAME>
+
 Modify repositories:
 
 	$ fdroidcl repo add <NAME> <URL>
 	$ fdroidcl repo remove <NAME>
 	$ fdroidcl repo enable <NAME>
 	$ fdroidcl repo disable <NAME>
+
+List or change the priority of repositories, with 1 being the highest:
+
+	$ fdroidcl repo priority
+	$ fdroidcl repo move <NAME> <POSITION>
+
+Private repositories can be given credentials and headers when added, which
+are also used to fetch their index the first time. Passwords and tokens are
+read from environment variables, to keep them out of the shell history:
+
+	$ fdroidcl repo -username <USER> -password-env <VAR> add <NAME> <URL>
+	$ fdroidcl repo -token-env <VAR> -header 'X-Api-Key: <KEY>' add <NAME> <URL>
 `[1:],
+	Mutates: true,
 }
 
+var (
+	repoUsername    = cmdRepo.Fset.String("username", "", "Username for basic auth, with add")
+	repoPasswordEnv = cmdRepo.Fset.String("password-env", "", "Environment variable holding the basic auth password, with add")
+	repoTokenEnv    = cmdRepo.Fset.String("token-env", "", "Environment variable holding the bearer token, with add")
+	repoNetrc       = cmdRepo.Fset.String("netrc", "", "Netrc file holding the credentials, with add")
+	repoHeaders     = headerFlag{}
+)
+
 func init() {
+	cmdRepo.Fset.Var(repoHeaders, "header", "Header to send to the repo, as 'Name: value', with add; may be repeated")
 	cmdRepo.Run = runRepo
+	cmdRepo.ReadOnly = func(args []string) bool {
+		return len(args) == 0 || args[0] == "info" || args[0] == "priority"
+	}
+}
+
+// headerFlag collects the headers given as repeated flags.
+type headerFlag map[string]string
+
+func (h headerFlag) String() string { return "" }
+
+func (h headerFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return fmt.Errorf("header must be 'Name: value'")
+	}
+	h[name] = strings.TrimSpace(value)
+	return nil
+}
+
+// repoAddAuth returns the credentials given as flags, if any.
+func repoAddAuth() *repoAuth {
+	auth := repoAuth{
+		Username:    *repoUsername,
+		PasswordEnv: *repoPasswordEnv,
+		TokenEnv:    *repoTokenEnv,
+		Netrc:       *repoNetrc,
+	}
+	if auth == (repoAuth{}) {
+		return nil
+	}
+	return &auth
 }
 
 func runRepo(args []string) error {
+	if (len(args) == 0 || args[0] != "add") && (repoAddAuth() != nil || len(repoHeaders) > 0) {
+		return fmt.Errorf("credentials and headers can only be given to add")
+	}
 	if len(args) == 0 {
 		// list repositories
 		for i, value := range config.Repos {
@@ -54,7 +136,7 @@ func runRepo(args []string) error {
 		if len(args) != 3 {
 			return fmt.Errorf("wrong amount of arguments")
 		}
-		return addRepo(args[1], args[2])
+		return addRepo(args[1], args[2], repoAddAuth(), repoHeaders)
 	} else if args[0] == "remove" {
 		if len(args) != 2 {
 			return fmt.Errorf("wrong amount of arguments")
@@ -70,6 +152,26 @@ func runRepo(args []string) error {
 			return fmt.Errorf("wrong amount of arguments")
 		}
 		return disableRepo(args[1])
+	} else if args[0] == "info" {
+		if len(args) != 2 {
+			return fmt.Errorf("wrong amount of arguments")
+		}
+		return repoInfo(args[1])
+	} else if args[0] == "priority" {
+		if len(args) != 1 {
+			return fmt.Errorf("wrong amount of arguments")
+		}
+		printRepoPriority()
+		return nil
+	} else if args[0] == "move" {
+		if len(args) != 3 {
+			return fmt.Errorf("wrong amount of arguments")
+		}
+		position, err := strconv.Atoi(args[2])
+		if err != nil {
+			return fmt.Errorf("invalid position: %q", args[2])
+		}
+		return moveRepo(args[1], position)
 	} else {
 		return fmt.Errorf("wrong usage")
 	}
@@ -86,12 +188,93 @@ func repoIndex(name string) int {
 	return index
 }
 
-func addRepo(name, url string) error {
+func addRepo(name, link string, auth *repoAuth, headers map[string]string) error {
 	if repoIndex(name) != -1 {
 		return fmt.Errorf("a repo with the same name \"%s\" exists already", name)
 	}
-	config.Repos = append(config.Repos, repo{ID: name, URL: url, Enabled: true})
-	return writeConfig(&config)
+	url, fingerprint, err := parseRepoLink(link)
+	if err != nil {
+		return err
+	}
+	r := repo{ID: name, URL: url, Enabled: true, Fingerprint: fingerprint, Auth: auth}
+	if len(headers) > 0 {
+		r.Headers = headers
+	}
+	if _, err := r.fingerprint(); err != nil {
+		return err
+	}
+
+	// Fetch the index before adding the repo, so that a wrong URL or
+	// fingerprint is caught right away.
+	state, err := readState()
+	if err != nil {
+		return err
+	}
+	st := state[name]
+	st.LastUpdate = time.Now().UnixMilli()
+	// The repo must be in the config for its credentials and headers to
+	// be sent, but it's only saved once its index has been fetched.
+	config.Repos = append(config.Repos, r)
+	if err := r.updateIndex(&st); err != nil && err != errNotModified {
+		config.Repos = config.Repos[:len(config.Repos)-1]
+		return fmt.Errorf("could not fetch the index of %s: %v", url, err)
+	}
+	index, err := r.indexRepo()
+	if err != nil {
+		config.Repos = config.Repos[:len(config.Repos)-1]
+		return fmt.Errorf("could not read the index of %s: %v", url, err)
+	}
+
+	if err := writeConfig(&config); err != nil {
+		return err
+	}
+	state[name] = st
+	if err := writeState(state); err != nil {
+		return err
+	}
+	removeCache()
+
+	fmt.Printf("Added repo %s\n", name)
+	fmt.Printf("Name: %s\n", index.Name)
+	if desc := strings.TrimSpace(index.Description); desc != "" {
+		fmt.Printf("Description: %s\n", desc)
+	}
+	if fingerprint != "" {
+		fmt.Printf("Fingerprint: %s\n", fingerprint)
+	}
+	return nil
+}
+
+// parseRepoLink splits a repo link as shared by F-Droid into the plain repo
+// URL and the fingerprint it carries, if any. The fdroidrepos:// and
+// fdroidrepo:// schemes stand for https:// and http:// respectively.
+func parseRepoLink(link string) (string, string, error) {
+	// QR codes hold links in uppercase, as that makes them smaller.
+	if link == strings.ToUpper(link) {
+		link = strings.ToLower(link)
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid repo URL: %v", err)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "fdroidrepos", "https":
+		u.Scheme = "https"
+	case "fdroidrepo", "http":
+		u.Scheme = "http"
+	default:
+		return "", "", fmt.Errorf("invalid repo URL %q: must be http, https or fdroidrepos", link)
+	}
+	if u.Host == "" {
+		return "", "", fmt.Errorf("invalid repo URL %q: missing host", link)
+	}
+	fingerprint := u.Query().Get("fingerprint")
+	fingerprint = normalizeFingerprint(fingerprint)
+	u.RawQuery = ""
+	u.Fragment = ""
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	return u.String(), fingerprint, nil
 }
 
 func removeRepo(name string) error {
@@ -99,8 +282,21 @@ func removeRepo(name string) error {
 	if index == -1 {
 		return fmt.Errorf("a repo with the name \"%s\" could not be found", name)
 	}
+	r := config.Repos[index]
 	config.Repos = append(config.Repos[:index], config.Repos[index+1:]...)
-	return writeConfig(&config)
+	if err := writeConfig(&config); err != nil {
+		return err
+	}
+	// Forget what we knew about the repo, such as its last index and
+	// its timestamp, in case a different one is added with the same name.
+	r.removeIndexes()
+	removeCache()
+	state, err := readState()
+	if err != nil {
+		return err
+	}
+	delete(state, name)
+	return writeState(state)
 }
 
 func enableRepo(name string) error {
@@ -109,7 +305,11 @@ func enableRepo(name string) error {
 		return fmt.Errorf("a repo with the name \"%s\" could not be found", name)
 	}
 	config.Repos[index].Enabled = true
-	return writeConfig(&config)
+	if err := writeConfig(&config); err != nil {
+		return err
+	}
+	removeCache()
+	return nil
 }
 
 func disableRepo(name string) error {
@@ -118,5 +318,169 @@ func disableRepo(name string) error {
 		return fmt.Errorf("a repo with the name \"%s\" could not be found", name)
 	}
 	config.Repos[index].Enabled = false
-	return writeConfig(&config)
+	if err := writeConfig(&config); err != nil {
+		return err
+	}
+	removeCache()
+	return nil
+}
+
+func printRepoPriority() {
+	for i, value := range config.Repos {
+		var disabled string
+		if !value.Enabled {
+			disabled = " (disabled)"
+		}
+		fmt.Printf("%d. %s - %s%s\n", i+1, value.ID, value.URL, disabled)
+	}
+}
+
+// moveRepo moves a repo to the given position in the list, starting at 1,
+// which is the highest priority.
+func moveRepo(name string, position int) error {
+	index := repoIndex(name)
+	if index == -1 {
+		return fmt.Errorf("a repo with the name \"%s\" could not be found", name)
+	}
+	if position < 1 || position > len(config.Repos) {
+		return fmt.Errorf("position must be between 1 and %d", len(config.Repos))
+	}
+	r := config.Repos[index]
+	repos := append(config.Repos[:index:index], config.Repos[index+1:]...)
+	repos = append(repos[:position-1], append([]repo{r}, repos[position-1:]...)...)
+	config.Repos = repos
+	if err := writeConfig(&config); err != nil {
+		return err
+	}
+	// The cached list of apps was merged in the old order.
+	removeCache()
+	printRepoPriority()
+	return nil
+}
+
+// repoInfo prints what we know about a repo and its index, without
+// downloading anything.
+func repoInfo(name string) error {
+	index := repoIndex(name)
+	if index == -1 {
+		return fmt.Errorf("a repo with the name \"%s\" could not be found", name)
+	}
+	r := &config.Repos[index]
+	state, err := readState()
+	if err != nil {
+		return err
+	}
+	st := state[name]
+	field := func(label, format string, a ...interface{}) {
+		fmt.Printf("%-14s: %s\n", label, fmt.Sprintf(format, a...))
+	}
+
+	field("ID", "%s", r.ID)
+	field("URL", "%s", r.URL)
+	if r.Enabled {
+		field("Enabled", "yes")
+	} else {
+		field("Enabled", "no")
+	}
+	field("Priority", "%d", index+1)
+	switch {
+	case st.LastUpdate == 0:
+		field("Last Update", "never")
+	case st.LastError != "":
+		field("Last Update", "%s, failed: %s", formatTime(time.UnixMilli(st.LastUpdate)), st.LastError)
+	default:
+		field("Last Update", "%s, succeeded", formatTime(time.UnixMilli(st.LastUpdate)))
+	}
+
+	idx, err := r.loadIndex()
+	if err == errNoIndex {
+		field("Index", "none yet; try 'fdroidcl update'")
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not load the index of %s: %v", name, err)
+	}
+	indexFile, signedFile := indexPath(name), indexPath(name)
+	format := "index-v1"
+	if _, err := os.Stat(indexV2Path(name)); err == nil {
+		indexFile, signedFile = indexV2Path(name), entryPath(name)
+		format = "index-v2"
+	}
+	repo := idx.Repo
+	field("Name", "%s", repo.Name)
+	if desc := strings.TrimSpace(repo.Description); desc != "" {
+		field("Description", "%s", desc)
+	}
+	if repo.Icon != "" {
+		field("Icon", "%s", repo.Icon)
+	}
+	field("Index", "%s, version %d", format, repo.Version)
+	field("Timestamp", "%s", formatTime(repo.Timestamp.Time))
+	if repo.MaxAge > 0 {
+		age := fmt.Sprintf("%d days", repo.MaxAge)
+		if time.Since(repo.Timestamp.Time) > time.Duration(repo.MaxAge)*24*time.Hour {
+			age += ", exceeded"
+		}
+		field("Max Age", "%s", age)
+	}
+	if info, err := os.Stat(indexFile); err == nil {
+		field("Downloaded", "%s", formatTime(info.ModTime()))
+	}
+	if etag, err := os.ReadFile(signedFile + "-etag"); err == nil {
+		field("ETag", "%s", strings.TrimSpace(string(etag)))
+	}
+	signer, err := jarSignerFingerprint(signedFile)
+	switch {
+	case err != nil:
+		field("Signer", "unknown: %v", err)
+	case r.Fingerprint != "":
+		field("Signer", "%s, pinned", hex.EncodeToString(signer))
+	default:
+		field("Signer", "%s, not pinned", hex.EncodeToString(signer))
+	}
+	apks := 0
+	for _, list := range idx.Packages {
+		apks += len(list)
+	}
+	field("Apps", "%d", len(idx.Apps))
+	field("APKs", "%d", apks)
+	return nil
+}
+
+// formatTime formats a time along with how long ago it was, in the largest
+// unit that fits.
+func formatTime(t time.Time) string {
+	s := t.UTC().Format(time.RFC3339)
+	switch d := time.Since(t); {
+	case d < time.Minute:
+		return s + " (just now)"
+	case d < time.Hour:
+		return fmt.Sprintf("%s (%d minutes ago)", s, int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%s (%d hours ago)", s, int(d.Hours()))
+	default:
+		return fmt.Sprintf("%s (%d days ago)", s, int(d.Hours()/24))
+	}
+}
+
+// jarSignerFingerprint returns the fingerprint of the certificate that signed
+// the jar at path.
+func jarSignerFingerprint(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(f, stat.Size())
+	if err != nil {
+		return nil, err
+	}
+	cert, err := fdroid.JarSigner(zr)
+	if err != nil {
+		return nil, err
+	}
+	return fdroid.CertFingerprint(cert.Raw), nil
 }
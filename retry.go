@@ -0,0 +1,160 @@
+// Copyright (c) 2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// The network settings below can be changed in the config; see setupRetries.
+var (
+	// connectTimeout limits how long it may take to connect to a server,
+	// including the TLS handshake.
+	connectTimeout = 30 * time.Second
+	// idleTimeout limits how long to wait for a server to send more data,
+	// be it the response headers or the next part of the body.
+	idleTimeout = 60 * time.Second
+	// httpRetries is how many times a failed download is retried.
+	httpRetries = 3
+	// retryDelay is how long to wait before the first retry. It doubles
+	// with each retry after that.
+	retryDelay = time.Second
+)
+
+const (
+	// maxRetryDelay caps the exponential backoff between retries.
+	maxRetryDelay = 30 * time.Second
+	// maxRetryAfter is the longest Retry-After that we will wait for.
+	// Servers asking for longer than that are given up on.
+	maxRetryAfter = 5 * time.Minute
+)
+
+func setupRetries() error {
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"connectTimeout", config.ConnectTimeout, &connectTimeout},
+		{"idleTimeout", config.IdleTimeout, &idleTimeout},
+		{"retryDelay", config.RetryDelay, &retryDelay},
+	} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil || v <= 0 {
+			return fmt.Errorf("invalid %s in config: %q", d.name, d.value)
+		}
+		*d.dst = v
+	}
+	if config.Retries != nil {
+		if *config.Retries < 0 {
+			return fmt.Errorf("invalid retries in config: %d", *config.Retries)
+		}
+		httpRetries = *config.Retries
+	}
+	httpTransport.DialContext = (&net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	httpTransport.TLSHandshakeTimeout = connectTimeout
+	httpTransport.ResponseHeaderTimeout = idleTimeout
+	return nil
+}
+
+// transientError is a network error, such as a connection reset or a
+// timeout, after which a download is retried.
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string { return e.err.Error() }
+func (e *transientError) Unwrap() error { return e.err }
+
+// retryWait returns how long to wait before the given attempt at retrying a
+// download which failed with err, starting at 1. It returns false if the
+// download should not be retried at all.
+func retryWait(err error, attempt int) (time.Duration, bool) {
+	if attempt > httpRetries {
+		return 0, false
+	}
+	wait := maxRetryDelay
+	if attempt < 16 && retryDelay<<(attempt-1) < maxRetryDelay {
+		wait = retryDelay << (attempt - 1)
+	}
+	var se *statusError
+	var te *transientError
+	switch {
+	case errors.As(err, &se):
+		if se.code < 500 && se.code != http.StatusTooManyRequests {
+			return 0, false
+		}
+		if se.retryAfter > maxRetryAfter {
+			return 0, false
+		} else if se.retryAfter > 0 {
+			wait = se.retryAfter
+		}
+	case errors.As(err, &te):
+	default:
+		return 0, false
+	}
+	return wait, true
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or a date. It returns 0 if the header is missing or invalid.
+func parseRetryAfter(h string) time.Duration {
+	if h == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(h); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil && time.Until(t) > 0 {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// idleReader fails with a transientError if reading from r stalls for longer
+// than timeout. cancel must abort the pending read, such as by canceling the
+// request's context.
+type idleReader struct {
+	r        io.Reader
+	timeout  time.Duration
+	timer    *time.Timer
+	timedOut atomic.Bool
+}
+
+func newIdleReader(r io.Reader, timeout time.Duration, cancel func()) *idleReader {
+	ir := &idleReader{r: r, timeout: timeout}
+	ir.timer = time.AfterFunc(timeout, func() {
+		ir.timedOut.Store(true)
+		cancel()
+	})
+	return ir
+}
+
+func (ir *idleReader) Read(p []byte) (int, error) {
+	n, err := ir.r.Read(p)
+	if ir.timedOut.Load() {
+		return n, &transientError{fmt.Errorf("no data received for %v", ir.timeout)}
+	}
+	ir.timer.Reset(ir.timeout)
+	if err != nil && err != io.EOF {
+		err = &transientError{err}
+	}
+	return n, err
+}
+
+// stop must be called once done reading.
+func (ir *idleReader) stop() { ir.timer.Stop() }
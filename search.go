@@ -4,12 +4,14 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"mvdan.cc/fdroidcl/adb"
@@ -29,6 +31,8 @@ var (
 	searchCategory  = cmdSearch.Fset.String("c", "", "Filter apps by category")
 	searchSortBy    = cmdSearch.Fset.String("o", "", "Sort order (added, updated)")
 	searchUser      = cmdSearch.Fset.String("user", "all", "Filter installed apps by user <USER_ID|current|all>")
+	searchDevices   = deviceFlags(&cmdSearch.Fset)
+	searchFormat    = cmdSearch.Fset.String("f", "", "Format each app with a Go template, such as '{{.PackageName}} {{.SugVersCode}}'")
 )
 
 func init() {
@@ -43,6 +47,15 @@ func runSearch(args []string) error {
 	if err != nil {
 		return err
 	}
+	var tmpl *template.Template
+	if *searchFormat != "" {
+		if *searchQuiet || *jsonOutput {
+			return fmt.Errorf("-f cannot be used along with -q or -json")
+		}
+		if tmpl, err = parseFormat(*searchFormat); err != nil {
+			return err
+		}
+	}
 	apps, err := loadIndexes()
 	if err != nil {
 		return err
@@ -56,52 +69,101 @@ func runSearch(args []string) error {
 	if len(apps) > 0 && len(args) > 0 {
 		apps = filterAppsSearch(apps, args)
 	}
-	var device *adb.Device
-	var inst map[string]adb.Package
-	if *searchInstalled || *searchUpdates {
-		if device, err = oneDevice(); err != nil {
-			return err
+	if len(apps) > 0 && *searchDays != 0 {
+		apps = filterAppsLastUpdated(apps, *searchDays)
+	}
+	if sfunc != nil {
+		apps = sortApps(apps, sfunc)
+	}
+	if !*searchInstalled && !*searchUpdates {
+		return printSearch(tmpl, apps, nil, nil)
+	}
+	devices, err := searchDevices.devices()
+	if err != nil {
+		return err
+	}
+	found := make([][]fdroid.App, len(devices))
+	insts := make([]map[string]adb.Package, len(devices))
+	_, errs := forEachDevice(devices, func(i int, out *deviceOutput) (string, error) {
+		var err error
+		insts[i], found[i], err = filterAppsDevice(apps, devices[i], out)
+		return "", err
+	})
+	for i, err := range errs {
+		if err == nil {
+			continue
 		}
-		if inst, err = device.Installed(); err != nil {
+		if len(devices) > 1 {
+			return fmt.Errorf("%s: %v", devices[i].ID, err)
+		}
+		return err
+	}
+	if *jsonOutput {
+		// A single list whatever the number of devices, where each
+		// app found on several of them appears once per device.
+		list := []jsonApp{}
+		for i, device := range devices {
+			list = append(list, appsJSON(found[i], insts[i], device)...)
+		}
+		return printJSON(list)
+	}
+	for i, device := range devices {
+		if len(devices) > 1 {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("%s (%s):\n", device.ID, device.Model)
+		}
+		if err := printSearch(tmpl, found[i], insts[i], device); err != nil {
 			return err
 		}
 	}
+	return nil
+}
+
+// filterAppsDevice applies the filters which depend on a device's installed
+// apps, such as -i and -u.
+func filterAppsDevice(apps []fdroid.App, device *adb.Device, out *deviceOutput) (map[string]adb.Package, []fdroid.App, error) {
+	inst, err := device.Installed()
+	if err != nil {
+		return nil, nil, err
+	}
 	var filterUser *int
 	if *searchUser != "all" && *searchUser != "current" {
 		n, err := strconv.Atoi(*searchUser)
 		if err != nil {
-			return fmt.Errorf("-user has to be <USER_ID|current|all>")
+			return nil, nil, fmt.Errorf("-user has to be <USER_ID|current|all>")
 		}
 		if n < 0 {
-			return fmt.Errorf("-user cannot have a negative number as USER_ID")
+			return nil, nil, fmt.Errorf("-user cannot have a negative number as USER_ID")
 		}
 		allUids := adb.AllUserIds(inst)
 		if _, exists := allUids[n]; !exists {
-			return fmt.Errorf("user %d does not exist", n)
+			return nil, nil, fmt.Errorf("user %d does not exist", n)
 		}
 		filterUser = &n
-	} else {
-		if *installUser == "current" {
-			uid, err := device.CurrentUserId()
-			if err != nil {
-				return err
-			}
-			filterUser = &uid
-		} else {
-			filterUser = nil
+	} else if *searchUser == "current" {
+		uid, err := device.CurrentUserId()
+		if err != nil {
+			return nil, nil, err
 		}
+		filterUser = &uid
 	}
 	if len(apps) > 0 && *searchInstalled {
 		apps = filterAppsInstalled(apps, inst, filterUser)
 	}
 	if len(apps) > 0 && *searchUpdates {
-		apps = filterAppsUpdates(apps, inst, device, filterUser)
+		apps = filterAppsUpdates(apps, inst, device, out, filterUser)
 	}
-	if len(apps) > 0 && *searchDays != 0 {
-		apps = filterAppsLastUpdated(apps, *searchDays)
+	return inst, apps, nil
+}
+
+func printSearch(tmpl *template.Template, apps []fdroid.App, inst map[string]adb.Package, device *adb.Device) error {
+	if *jsonOutput {
+		return printJSON(appsJSON(apps, inst, device))
 	}
-	if sfunc != nil {
-		apps = sortApps(apps, sfunc)
+	if tmpl != nil {
+		return printFormat(tmpl, apps, inst, device)
 	}
 	if *searchQuiet {
 		for _, app := range apps {
@@ -206,7 +268,9 @@ func filterAppsInstalled(apps []fdroid.App, inst map[string]adb.Package, user *i
 	return result
 }
 
-func filterAppsUpdates(apps []fdroid.App, inst map[string]adb.Package, device *adb.Device, user *int) []fdroid.App {
+// filterAppsUpdates keeps the apps with updates for the device. Any apps
+// skipped because of a different signer are reported to out.
+func filterAppsUpdates(apps []fdroid.App, inst map[string]adb.Package, device *adb.Device, out *deviceOutput, user *int) []fdroid.App {
 	var result []fdroid.App
 	for _, app := range apps {
 		p, e := inst[app.PackageName]
@@ -232,11 +296,46 @@ func filterAppsUpdates(apps []fdroid.App, inst map[string]adb.Package, device *a
 		if p.VersCode >= suggested.VersCode {
 			continue
 		}
+		if len(suggested.Signer) > 0 {
+			signers, err := installedSigners(device, app.PackageName)
+			if err != nil {
+				out.Fprintf(os.Stderr, "warning: could not check the signer of %s: %v\n", app.PackageName, err)
+			} else if !containsSigner(signers, suggested.Signer) {
+				out.Fprintf(os.Stderr, "skipping %s: the installed app has a different signer, so it likely comes from Google Play or an upstream build\n", app.PackageName)
+				continue
+			}
+		}
 		result = append(result, app)
 	}
 	return result
 }
 
+// installedSigners returns the fingerprints of the certificates which signed
+// the APK of a package installed on the device. Only the parts of the APK
+// holding the signatures are read. dumpsys package can't be used instead, as
+// it only shows the Java hash codes of the certificates, which can't be
+// compared with the SHA-256 fingerprints in the index.
+func installedSigners(device *adb.Device, pkg string) ([][]byte, error) {
+	paths, err := device.PackagePaths(pkg)
+	if err != nil {
+		return nil, err
+	}
+	f, err := device.OpenFile(paths[0])
+	if err != nil {
+		return nil, err
+	}
+	return fdroid.ApkSignerFingerprints(f, f.Size())
+}
+
+func containsSigner(signers [][]byte, signer []byte) bool {
+	for _, s := range signers {
+		if bytes.Equal(s, signer) {
+			return true
+		}
+	}
+	return false
+}
+
 func filterAppsLastUpdated(apps []fdroid.App, days int) []fdroid.App {
 	var result []fdroid.App
 	newer := true
@@ -17,6 +17,8 @@ var cmdShow = &Command{
 	Short:     "Show detailed info about apps",
 }
 
+var showFormat = cmdShow.Fset.String("f", "", "Format each app with a Go template, such as '{{.Name}} {{.Suggested.VersName}}'")
+
 func init() {
 	cmdShow.Run = runShow
 }
@@ -29,6 +31,23 @@ func runShow(args []string) error {
 	if err != nil {
 		return err
 	}
+	if *showFormat != "" {
+		if *jsonOutput {
+			return fmt.Errorf("-f cannot be used along with -json")
+		}
+		tmpl, err := parseFormat(*showFormat)
+		if err != nil {
+			return err
+		}
+		return printFormat(tmpl, apps, nil, nil)
+	}
+	if *jsonOutput {
+		list := make([]jsonAppDetailed, len(apps))
+		for i, app := range apps {
+			list[i] = appDetailedJSON(app)
+		}
+		return printJSON(list)
+	}
 	for i, app := range apps {
 		if i > 0 {
 			fmt.Printf("\n--\n\n")
@@ -66,24 +85,34 @@ func findApps(ids []string) ([]fdroid.App, error) {
 			id = id[:j]
 		}
 
-		app, e := byId[id]
+		indexApp, e := byId[id]
 		if !e {
 			return nil, fmt.Errorf("could not find app with ID '%s'", id)
 		}
+		// Copy the app, as the same one may be asked for with another
+		// version code.
+		app := *indexApp
 
 		if vcode > -1 {
+			// The APKs are in order of repo priority, so the first
+			// match is preferred, unless the app is pinned to a repo.
 			found := false
 			for _, apk := range app.Apks {
-				if apk.VersCode == vcode {
-					app.Apks = []*fdroid.Apk{apk}
-					found = true
+				if apk.VersCode != vcode {
+					continue
 				}
+				if app.PinnedRepo != "" && apk.RepoName != app.PinnedRepo {
+					continue
+				}
+				app.Apks = []*fdroid.Apk{apk}
+				found = true
+				break
 			}
 			if !found {
 				return nil, fmt.Errorf("could not find version %d for app with ID '%s'", vcode, id)
 			}
 		}
-		result[i] = *app
+		result[i] = app
 	}
 	return result, nil
 }
@@ -99,6 +128,9 @@ func printAppDetailed(app fdroid.App) {
 	if app.Categories != nil {
 		fmt.Printf("Categories           : %s\n", strings.Join(app.Categories, ", "))
 	}
+	if app.AntiFeatures != nil {
+		fmt.Printf("Anti-Features        : %s\n", strings.Join(app.AntiFeatures, ", "))
+	}
 	if app.Website != "" {
 		fmt.Printf("Website              : %s\n", app.Website)
 	}
@@ -124,6 +156,9 @@ func printAppDetailed(app fdroid.App) {
 		fmt.Printf("Flattr               : https://flattr.com/thing/%s\n", app.FlattrID)
 	}
 	fmt.Printf("F-Droid Repository   : %s (%s)\n", app.FdroidRepoName, app.FdroidRepoURL)
+	if app.PinnedRepo != "" {
+		fmt.Printf("Pinned Repository    : %s\n", app.PinnedRepo)
+	}
 	fmt.Println()
 	fmt.Println("Description :")
 	fmt.Println()
@@ -133,6 +168,7 @@ func printAppDetailed(app fdroid.App) {
 	for _, apk := range app.Apks {
 		fmt.Println()
 		fmt.Printf("    Version : %s (%d)\n", apk.VersName, apk.VersCode)
+		fmt.Printf("    Repo    : %s\n", apkRepoDesc(apk))
 		fmt.Printf("    Size    : %d\n", apk.Size)
 		fmt.Printf("    MinSdk  : %d\n", apk.MinSdk.Value)
 		if apk.MaxSdk.Value > 0 {
@@ -156,3 +192,13 @@ func printAppDetailed(app fdroid.App) {
 		}
 	}
 }
+
+// apkRepoDesc describes the repository that an APK comes from, including its
+// priority, which decides between APKs with the same version code.
+func apkRepoDesc(apk *fdroid.Apk) string {
+	i := repoIndex(apk.RepoName)
+	if i == -1 {
+		return apk.RepoName
+	}
+	return fmt.Sprintf("%s (priority %d)", apk.RepoName, i+1)
+}
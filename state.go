@@ -0,0 +1,59 @@
+// Copyright (c) 2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// repoState is what we remember about a repository between runs. Unlike
+// userConfig, it is never edited by the user.
+type repoState struct {
+	// Timestamp is the timestamp of the last index accepted from the
+	// repository, in milliseconds since the epoch.
+	Timestamp int64 `json:"timestamp"`
+	// Mirror is the base URL that the repository was last downloaded
+	// from successfully, which is tried first next time.
+	Mirror string `json:"mirror,omitempty"`
+	// LastUpdate is when the repository was last updated, in milliseconds
+	// since the epoch, and LastError is why that failed, if it did.
+	LastUpdate int64  `json:"lastUpdate,omitempty"`
+	LastError  string `json:"lastError,omitempty"`
+}
+
+// indexChanged reports whether st2 refers to a different index than st, or
+// to a different mirror, meaning that the cached list of apps is outdated.
+func (st repoState) indexChanged(st2 repoState) bool {
+	return st.Timestamp != st2.Timestamp || st.Mirror != st2.Mirror
+}
+
+func statePath() string {
+	return filepath.Join(mustData(), "state.json")
+}
+
+func readState() (map[string]repoState, error) {
+	state := make(map[string]repoState)
+	f, err := os.Open(statePath())
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&state); err != nil {
+		return nil, fmt.Errorf("cannot decode %s: %v", statePath(), err)
+	}
+	return state, nil
+}
+
+func writeState(state map[string]repoState) error {
+	b, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return fmt.Errorf("cannot encode state: %v", err)
+	}
+	return writeFileBytes(statePath(), b)
+}
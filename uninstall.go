@@ -17,7 +17,8 @@ var cmdUninstall = &Command{
 }
 
 var (
-	uninstallUser = cmdUninstall.Fset.String("user", "all", "Uninstall for specified user <USER_ID|current|all>")
+	uninstallUser    = cmdUninstall.Fset.String("user", "all", "Uninstall for specified user <USER_ID|current|all>")
+	uninstallDevices = deviceFlags(&cmdUninstall.Fset)
 )
 
 func init() {
@@ -28,46 +29,54 @@ func runUninstall(args []string) error {
 	if len(args) < 1 {
 		return fmt.Errorf("no package names given")
 	}
-	device, err := oneDevice()
+	devices, err := uninstallDevices.devices()
 	if err != nil {
 		return err
 	}
+	results, errs := forEachDevice(devices, func(i int, out *deviceOutput) (string, error) {
+		return uninstallFrom(devices[i], out, args)
+	})
+	return deviceSummary(devices, results, errs)
+}
+
+func uninstallFrom(device *adb.Device, out *deviceOutput, args []string) (string, error) {
 	inst, err := device.Installed()
 	if err != nil {
-		return err
+		return "", err
 	}
-	if *uninstallUser != "all" && *uninstallUser != "current" {
-		n, err := strconv.Atoi(*uninstallUser)
+	user := *uninstallUser
+	if user != "all" && user != "current" {
+		n, err := strconv.Atoi(user)
 		if err != nil {
-			return fmt.Errorf("-user has to be <USER_ID|current|all>")
+			return "", fmt.Errorf("-user has to be <USER_ID|current|all>")
 		}
 		if n < 0 {
-			return fmt.Errorf("-user cannot have a negative number as USER_ID")
+			return "", fmt.Errorf("-user cannot have a negative number as USER_ID")
 		}
 		allUids := adb.AllUserIds(inst)
 		if _, exists := allUids[n]; !exists {
-			return fmt.Errorf("user %d does not exist", n)
+			return "", fmt.Errorf("user %d does not exist", n)
 		}
 	}
-	if *uninstallUser == "current" {
+	if user == "current" {
 		uid, err := device.CurrentUserId()
 		if err != nil {
-			return err
+			return "", err
 		}
-		*uninstallUser = strconv.Itoa(uid)
+		user = strconv.Itoa(uid)
 	}
 	for _, id := range args {
 		var err error
-		fmt.Printf("Uninstalling %s\n", id)
+		out.Printf("Uninstalling %s\n", id)
 		app, installed := inst[id]
 		if installed {
 			installedForUser := false
-			if *uninstallUser == "all" {
+			if user == "all" {
 				installedForUser = true
 			} else {
-				uid, err := strconv.Atoi(*uninstallUser)
+				uid, err := strconv.Atoi(user)
 				if err != nil {
-					return err
+					return "", err
 				}
 				for _, appUser := range app.InstalledForUsers {
 					if appUser == uid {
@@ -77,10 +86,10 @@ func runUninstall(args []string) error {
 				}
 			}
 			if installedForUser {
-				if *uninstallUser == "all" {
+				if user == "all" {
 					err = device.Uninstall(id)
 				} else {
-					err = device.UninstallUser(id, *uninstallUser)
+					err = device.UninstallUser(id, user)
 				}
 			} else {
 				err = errors.New("not installed for user")
@@ -89,8 +98,8 @@ func runUninstall(args []string) error {
 			err = errors.New("not installed")
 		}
 		if err != nil {
-			return fmt.Errorf("could not uninstall %s: %v", id, err)
+			return "", fmt.Errorf("could not uninstall %s: %v", id, err)
 		}
 	}
-	return nil
+	return fmt.Sprintf("%d uninstalled", len(args)), nil
 }
@@ -5,70 +5,435 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
-	"runtime"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
 	"time"
 
-	"github.com/schollz/progressbar/v3"
 	"mvdan.cc/fdroidcl/fdroid"
 )
 
 var cmdUpdate = &Command{
 	UsageLine: "update",
 	Short:     "Update the index",
+	Mutates:   true,
 }
 
+var (
+	updateAllowRollback = cmdUpdate.Fset.Bool("allow-rollback", false, "Accept indexes older than the last ones accepted")
+	updateStrict        = cmdUpdate.Fset.Bool("strict", false, "Fail if any of the repositories could not be updated")
+)
+
 func init() {
 	cmdUpdate.Run = runUpdate
 }
 
 func runUpdate(args []string) error {
-	anyModified := false
-	for _, r := range config.Repos {
-		if !r.Enabled {
+	state, err := readState()
+	if err != nil {
+		return err
+	}
+	var repos []*repo
+	for i := range config.Repos {
+		if config.Repos[i].Enabled {
+			repos = append(repos, &config.Repos[i])
+		}
+	}
+	states := make([]repoState, len(repos))
+	errs := make([]error, len(repos))
+	stopBars := startBars()
+	var wg sync.WaitGroup
+	for i, r := range repos {
+		states[i] = state[r.ID]
+		wg.Add(1)
+		go func(i int, r *repo) {
+			defer wg.Done()
+			errs[i] = r.updateIndex(&states[i])
+		}(i, r)
+	}
+	wg.Wait()
+	stopBars()
+
+	now := time.Now().UnixMilli()
+	indexChanged := false
+	failed := 0
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "Summary:")
+	for i, r := range repos {
+		switch err := errs[i]; {
+		case err == errNotModified:
+			fmt.Fprintf(tw, "    %s\tnot modified\n", r.ID)
+		case err != nil:
+			failed++
+			fmt.Fprintf(tw, "    %s\tfailed: %v\n", r.ID, err)
+			// Only record the failure, keeping what we knew about
+			// the index we still have.
+			st := state[r.ID]
+			st.LastUpdate, st.LastError = now, err.Error()
+			state[r.ID] = st
 			continue
+		default:
+			fmt.Fprintf(tw, "    %s\tupdated\n", r.ID)
 		}
-		if err := r.updateIndex(); err == errNotModified {
-		} else if err != nil {
-			return fmt.Errorf("could not update index: %v", err)
-		} else {
-			anyModified = true
+		// Record the new index timestamp, or the mirror that worked.
+		if states[i].indexChanged(state[r.ID]) {
+			indexChanged = true
 		}
+		states[i].LastUpdate, states[i].LastError = now, ""
+		state[r.ID] = states[i]
+	}
+	tw.Flush()
+	if len(repos) > 0 {
+		if err := writeState(state); err != nil {
+			return err
+		}
+	}
+	if indexChanged {
+		removeCache()
+	}
+	// A repo that can't be updated shouldn't hold back the others, so
+	// failures are only fatal with -strict.
+	if failed > 0 && *updateStrict {
+		if len(repos) == 1 {
+			return fmt.Errorf("could not update index: %v", errs[0])
+		}
+		return fmt.Errorf("could not update %d out of %d repositories", failed, len(repos))
+	}
+	return nil
+}
+
+const (
+	jarFile   = "index-v1.jar"
+	entryFile = "entry.jar"
+)
+
+func (r *repo) updateIndex(st *repoState) error {
+	fingerprint, err := r.fingerprint()
+	if err != nil {
+		return err
+	}
+	err = r.updateIndexV2(fingerprint, st)
+	if !isNotFound(err) {
+		return err
+	}
+	// Older repos only publish index-v1. Drop any index-v2 files left
+	// over, as they take precedence when loading the index.
+	r.removeIndexV2()
+
+	// The index is only moved into place once checked, so that the last
+	// one accepted is kept if the new one is refused.
+	return r.download(jarFile, indexPath(r.ID), nil, st, false, func(path string) error {
+		return r.checkIndexJar(path, fingerprint, st)
+	})
+}
+
+// updateIndexV2 fetches the signed entry.jar, and then the index-v2.json it
+// points to. It fails with a 404 error if the repo doesn't support index-v2.
+func (r *repo) updateIndexV2(fingerprint []byte, st *repoState) error {
+	p := entryPath(r.ID)
+	// The entry is only moved into place once the index it points to is,
+	// so that the two always match.
+	err := r.download(entryFile, p, nil, st, true, func(path string) error {
+		entry, err := loadEntry(path, fingerprint)
+		if err != nil {
+			return err
+		}
+		if err := r.checkTimestamp(entry.Timestamp, entry.MaxAge, st); err != nil {
+			return err
+		}
+		return r.updateIndexV2JSON(entry, st)
+	})
+	if err != errNotModified {
+		return err
+	}
+	entry, err := loadEntry(p, fingerprint)
+	if err != nil {
+		return fmt.Errorf("%s/%s: %v", r.URL, entryFile, err)
+	}
+	if checkIndexV2(indexV2Path(r.ID), entry) == nil {
+		return errNotModified
+	}
+	// The entry was accepted before, but its index is missing or doesn't
+	// match it.
+	return r.updateIndexV2JSON(entry, st)
+}
+
+// updateIndexV2JSON brings index-v2.json up to date with the entry, by
+// patching it if possible and downloading it in full otherwise.
+func (r *repo) updateIndexV2JSON(entry *fdroid.Entry, st *repoState) error {
+	if err := r.patchIndexV2(entry, st); err == nil {
+		return nil
+	} else if err != errNoDiff {
+		lockedPrintf("could not apply index diff, downloading the full index: %v\n", err)
+	}
+	ip := indexV2Path(r.ID)
+	err := r.download(entry.Index.Name, ip, entry.Index.Sha256, st, false, nil)
+	if err == errNotModified {
+		// The entry changed, so make sure that our copy of the index
+		// is still the one it points to.
+		if err = checkSum(ip, entry.Index.Sha256); err != nil {
+			os.Remove(ip + "-etag")
+			err = r.download(entry.Index.Name, ip, entry.Index.Sha256, st, false, nil)
+		}
+	}
+	if err == errNotModified {
+		return nil
+	}
+	return err
+}
+
+var errNoDiff = fmt.Errorf("no applicable diff")
+
+// patchIndexV2 brings the local index-v2.json up to date with the entry by
+// applying the diff from its timestamp, if the repo publishes one. It
+// returns errNoDiff if there is no local index or no suitable diff.
+func (r *repo) patchIndexV2(entry *fdroid.Entry, st *repoState) error {
+	ip := indexV2Path(r.ID)
+	f, err := os.Open(ip)
+	if err != nil {
+		return errNoDiff
+	}
+	defer f.Close()
+	ts, err := fdroid.IndexV2Timestamp(f)
+	if err != nil {
+		return errNoDiff
+	}
+	if ts == entry.Timestamp.UnixMilli() {
+		return checkIndexV2(ip, entry)
+	}
+	diff, ok := entry.Diffs[strconv.FormatInt(ts, 10)]
+	if !ok {
+		return errNoDiff
+	}
+
+	diffPath := ip + "-diff"
+	os.Remove(diffPath)
+	defer os.Remove(diffPath)
+	defer os.Remove(diffPath + "-etag")
+	if err := r.download(diff.Name, diffPath, diff.Sha256, st, true, nil); isNotFound(err) {
+		return errNoDiff
+	} else if err != nil {
+		return err
+	}
+	df, err := os.Open(diffPath)
+	if err != nil {
+		return err
+	}
+	defer df.Close()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := fdroid.PatchIndexV2JSON(&buf, f, df); err != nil {
+		return err
+	}
+	// Windows won't replace a file that's still open.
+	f.Close()
+	ts, err = fdroid.IndexV2Timestamp(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return err
+	}
+	if ts != entry.Timestamp.UnixMilli() {
+		return fmt.Errorf("patched index has timestamp %d, want %d", ts, entry.Timestamp.UnixMilli())
+	}
+	if err := writeFileBytes(ip, buf.Bytes()); err != nil {
+		return err
+	}
+	// The patched index no longer matches the server's copy byte by byte.
+	os.Remove(ip + "-etag")
+	return nil
+}
+
+func (r *repo) removeIndexV2() {
+	for _, p := range []string{entryPath(r.ID), indexV2Path(r.ID)} {
+		os.Remove(p)
+		os.Remove(p + "-etag")
+	}
+}
+
+// removeIndexes removes all the index files of a repo, including any
+// partial downloads.
+func (r *repo) removeIndexes() {
+	for _, p := range []string{indexPath(r.ID), entryPath(r.ID), indexV2Path(r.ID)} {
+		os.Remove(p)
+		os.Remove(p + "-etag")
+		removePart(p + ".part")
+	}
+}
+
+// checkIndexV2 checks that the index-v2.json at path is the one the entry
+// points to. A copy we patched ourselves can't match the checksum of the
+// full index, so it must carry the entry's timestamp instead.
+func checkIndexV2(path string, entry *fdroid.Entry) error {
+	if checkSum(path, entry.Index.Sha256) == nil {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	ts, err := fdroid.IndexV2Timestamp(f)
+	if err != nil {
+		return err
+	}
+	if ts != entry.Timestamp.UnixMilli() {
+		return fmt.Errorf("%s does not match %s", filepath.Base(path), entryFile)
+	}
+	return nil
+}
+
+func loadEntry(path string, fingerprint []byte) (*fdroid.Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return fdroid.LoadEntryJar(f, stat.Size(), fingerprint)
+}
+
+func checkSum(path string, sum []byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
 	}
-	if anyModified {
-		cachePath := filepath.Join(mustCache(), "cache-gob")
-		os.Remove(cachePath)
+	if !bytes.Equal(sum, hash.Sum(nil)) {
+		return fmt.Errorf("%s sha256 mismatch", path)
 	}
 	return nil
 }
 
-const jarFile = "index-v1.jar"
+// normalizeFingerprint writes a fingerprint in lowercase hex, without any
+// separators.
+func normalizeFingerprint(s string) string {
+	return strings.NewReplacer(":", "", " ", "").Replace(strings.ToLower(s))
+}
 
-func (r *repo) updateIndex() error {
-	url := fmt.Sprintf("%s/%s", r.URL, jarFile)
-	return downloadEtag(url, indexPath(r.ID), nil)
+// fingerprint decodes the repo's pinned signer fingerprint, which may be
+// written in upper or lower case and contain colons or spaces. It returns
+// nil if the repo has no pinned fingerprint.
+func (r *repo) fingerprint() ([]byte, error) {
+	if r.Fingerprint == "" {
+		return nil, nil
+	}
+	b, err := hex.DecodeString(normalizeFingerprint(r.Fingerprint))
+	if err != nil || len(b) != sha256.Size {
+		return nil, fmt.Errorf("invalid fingerprint for repo %s: %q", r.ID, r.Fingerprint)
+	}
+	return b, nil
 }
 
+// checkIndexJar verifies a freshly downloaded index-v1.jar before accepting
+// it, checking its signature and timestamp.
+func (r *repo) checkIndexJar(path string, fingerprint []byte, st *repoState) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fingerprint != nil {
+		if err := fdroid.VerifyIndexJar(f, stat.Size(), fingerprint); err != nil {
+			return err
+		}
+	}
+	repo, err := fdroid.LoadIndexJarRepo(f, stat.Size())
+	if err != nil {
+		return err
+	}
+	return r.checkTimestamp(repo.Timestamp, repo.MaxAge, st)
+}
+
+// checkTimestamp refuses an index older than the last one accepted from the
+// repo, as a stale mirror or an attacker could otherwise hold back updates
+// by serving an older index that is still correctly signed. It also warns if
+// the index is older than the maximum age advertised by the repo, in days.
+func (r *repo) checkTimestamp(ts fdroid.UnixDate, maxAge int, st *repoState) error {
+	ms := ts.UnixMilli()
+	if ms < st.Timestamp && !*updateAllowRollback {
+		last := time.UnixMilli(st.Timestamp).UTC()
+		return fmt.Errorf("index from %s is older than the last one accepted, from %s; use -allow-rollback to accept it",
+			ts.Format(time.RFC3339), last.Format(time.RFC3339))
+	}
+	if maxAge > 0 {
+		if days := int(time.Since(ts.Time).Hours() / 24); days > maxAge {
+			lockedFprintf(os.Stderr, "warning: index of repo %s is %d days old, more than its max age of %d days\n",
+				r.ID, days, maxAge)
+		}
+	}
+	st.Timestamp = ms
+	return nil
+}
+
+var errNoIndex = fmt.Errorf("index does not exist; try 'fdroidcl update'")
+
 func (r *repo) loadIndex() (*fdroid.Index, error) {
+	fingerprint, err := r.fingerprint()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(indexV2Path(r.ID)); err == nil {
+		return r.loadIndexV2(fingerprint)
+	}
 	p := indexPath(r.ID)
 	f, err := os.Open(p)
 	if os.IsNotExist(err) {
-		return nil, fmt.Errorf("index does not exist; try 'fdroidcl update'")
+		return nil, errNoIndex
 	} else if err != nil {
 		return nil, fmt.Errorf("could not open index: %v", err)
 	}
+	defer f.Close()
 	stat, err := f.Stat()
 	if err != nil {
 		return nil, fmt.Errorf("could not stat index: %v", err)
 	}
-	return fdroid.LoadIndexJar(f, stat.Size(), nil)
+	return fdroid.LoadIndexJar(f, stat.Size(), fingerprint)
+}
+
+func (r *repo) loadIndexV2(fingerprint []byte) (*fdroid.Index, error) {
+	entry, err := loadEntry(entryPath(r.ID), fingerprint)
+	if err != nil {
+		return nil, fmt.Errorf("could not load entry: %v", err)
+	}
+	if err := checkIndexV2(indexV2Path(r.ID), entry); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(indexV2Path(r.ID))
+	if err != nil {
+		return nil, fmt.Errorf("could not open index: %v", err)
+	}
+	defer f.Close()
+	index, err := fdroid.LoadIndexV2JSON(f)
+	if err != nil {
+		return nil, err
+	}
+	index.Repo.Version = entry.Version
+	index.Repo.MaxAge = entry.MaxAge
+	return index, nil
 }
 
 func respEtag(resp *http.Response) string {
@@ -81,10 +446,53 @@ func respEtag(resp *http.Response) string {
 
 var errNotModified = fmt.Errorf("not modified")
 
-var httpClient = &http.Client{}
+// statusError is returned by downloadEtag when the server responds with an
+// HTTP error status.
+type statusError struct {
+	url  string
+	code int
+	// retryAfter is the wait requested by the server, if any.
+	retryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s download failed: %d %s",
+		e.url, e.code, http.StatusText(e.code))
+}
+
+func isNotFound(err error) bool {
+	var se *statusError
+	return errors.As(err, &se) && se.code == http.StatusNotFound
+}
+
+// downloadEtag downloads url to target_path, unless the server reports that
+// the copy downloaded before is still current. If sum is not nil, the
+// download's sha256 must match it, and if verify is not nil, it must accept
+// the complete download before it replaces the copy from before.
+//
+// The download is written to a ".part" file first, which is only moved into
+// place once complete and verified. If a previous download was interrupted,
+// the part file is resumed via a range request, as long as its ETag still
+// matches.
+//
+// Network and server errors are retried with an exponential backoff, as
+// configured by setupRetries.
+func downloadEtag(url, target_path string, sum []byte, verify func(path string) error) error {
+	for attempt := 1; ; attempt++ {
+		err := downloadEtagOnce(url, target_path, sum, verify)
+		wait, retry := retryWait(err, attempt)
+		if !retry {
+			return err
+		}
+		lockedFprintf(os.Stderr, "warning: %v; retrying in %v\n", err, wait)
+		time.Sleep(wait)
+	}
+}
 
-func downloadEtag(url, target_path string, sum []byte) error {
-	req, err := http.NewRequest("GET", url, nil)
+func downloadEtagOnce(url, target_path string, sum []byte, verify func(path string) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return err
 	}
@@ -94,71 +502,158 @@ func downloadEtag(url, target_path string, sum []byte) error {
 		etag, _ := os.ReadFile(etagPath)
 		req.Header.Add("If-None-Match", string(etag))
 	}
+	partPath := target_path + ".part"
+	partEtagPath := partPath + "-etag"
+	var offset int64
+	if info, err := os.Stat(partPath); err == nil && info.Size() > 0 {
+		etag, _ := os.ReadFile(partEtagPath)
+		if etag := strings.TrimSpace(string(etag)); etag != "" {
+			offset = info.Size()
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+			req.Header.Set("If-Range", etag)
+		}
+	}
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		return err
+		var ae *authError
+		if errors.As(err, &ae) {
+			return ae
+		}
+		return &transientError{err}
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0 {
+		// The part file is no good; start from scratch.
+		resp.Body.Close()
+		removePart(partPath)
+		return downloadEtagOnce(url, target_path, sum, verify)
+	}
 	if resp.StatusCode >= 400 {
-		return fmt.Errorf("%s download failed: %d %s",
-			url, resp.StatusCode, http.StatusText(resp.StatusCode))
+		return &statusError{
+			url:        url,
+			code:       resp.StatusCode,
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
 	}
 	if resp.StatusCode == http.StatusNotModified {
-		fmt.Printf("%s not modified\n", url)
+		lockedPrintf("%s not modified\n", url)
 		return errNotModified
 	}
-	f, err := os.OpenFile(target_path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if resp.StatusCode != http.StatusPartialContent ||
+		!strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+		// The server sent the whole file.
+		offset = 0
+	}
+	flags := os.O_RDWR | os.O_CREATE | os.O_APPEND
+	if offset == 0 {
+		flags |= os.O_TRUNC
+		// Record the ETag before any of the body, so that an interrupted
+		// download can be resumed.
+		if err := os.WriteFile(partEtagPath, []byte(respEtag(resp)), 0o644); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(partPath, flags, 0o644)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	bar := progressbar.NewOptions64(
-		resp.ContentLength,
-		progressbar.OptionSetDescription(url),
-		progressbar.OptionSetWriter(os.Stdout),
-		progressbar.OptionShowBytes(true),
-		progressbar.OptionThrottle(50*time.Millisecond),
-		progressbar.OptionShowCount(),
-		progressbar.OptionOnCompletion(func() {
-			fmt.Fprint(os.Stdout, "\n")
-		}),
-		progressbar.OptionSpinnerType(14),
-		progressbar.OptionSetRenderBlankState(true),
-		progressbar.OptionUseANSICodes(runtime.GOOS != "windows"),
-		progressbar.OptionFullWidth(),
-	)
-	if sum == nil {
-		_, err := io.Copy(io.MultiWriter(f, bar), resp.Body)
-		if err != nil {
+	hash := sha256.New()
+	if offset > 0 {
+		// Resuming; the part downloaded before is verified too.
+		if _, err := io.Copy(hash, io.NewSectionReader(f, 0, offset)); err != nil {
 			return err
 		}
-	} else {
-		hash := sha256.New()
-		_, err := io.Copy(io.MultiWriter(f, bar, hash), resp.Body)
-		if err != nil {
-			return err
+	}
+	size := resp.ContentLength
+	if size >= 0 {
+		size += offset
+	}
+	bar := newProgressBar(size, url)
+	defer func() {
+		// Bars of unknown size or interrupted transfers never finish.
+		if !bar.IsFinished() {
+			bar.Exit()
+		}
+	}()
+	bar.Add64(offset)
+	body := newIdleReader(resp.Body, idleTimeout, cancel)
+	defer body.stop()
+	if _, err := io.Copy(io.MultiWriter(f, bar, hash), body); err != nil {
+		var te *transientError
+		if errors.As(err, &te) {
+			return &transientError{fmt.Errorf("%s download interrupted: %v", url, te.err)}
 		}
-		got := hash.Sum(nil)
-		if !bytes.Equal(sum, got[:]) {
+		return err
+	}
+	if sum != nil {
+		if got := hash.Sum(nil); !bytes.Equal(sum, got) {
+			removePart(partPath)
 			return fmt.Errorf("%s sha256 mismatch", url)
 		}
 	}
-	if err := os.WriteFile(etagPath, []byte(respEtag(resp)), 0o644); err != nil {
+	if err := f.Sync(); err != nil {
 		return err
 	}
-	return nil
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if verify != nil {
+		if err := verify(partPath); err != nil {
+			removePart(partPath)
+			return fmt.Errorf("%s: %v", url, err)
+		}
+	}
+	// Only record the ETag once the body is in place, so that a stale
+	// ETag can never be paired with a newer body.
+	os.Remove(etagPath)
+	if err := renameSynced(partPath, target_path); err != nil {
+		return err
+	}
+	os.Remove(partEtagPath)
+	return writeFileBytes(etagPath, []byte(respEtag(resp)))
+}
+
+// removePart removes a part file and its ETag, so that the next download
+// starts from scratch.
+func removePart(partPath string) {
+	os.Remove(partPath)
+	os.Remove(partPath + "-etag")
 }
 
 func indexPath(name string) string {
 	return filepath.Join(mustData(), name+".jar")
 }
 
-const cacheVersion = 2
+func entryPath(name string) string {
+	return filepath.Join(mustData(), name+"-entry.jar")
+}
+
+func indexV2Path(name string) string {
+	return filepath.Join(mustData(), name+"-index-v2.json")
+}
+
+const cacheVersion = 6
 
 type cache struct {
 	Version int
-	Apps    []fdroid.App
+	// PinnedRepos is the config's field of the same name that the apps
+	// were merged with.
+	PinnedRepos map[string]string
+	Apps        []fdroid.App
+}
+
+func samePins(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for pkg, id := range a {
+		if bid, e := b[pkg]; !e || bid != id {
+			return false
+		}
+	}
+	return true
 }
 
 type apkPtrList []*fdroid.Apk
@@ -167,28 +662,56 @@ func (al apkPtrList) Len() int           { return len(al) }
 func (al apkPtrList) Swap(i, j int)      { al[i], al[j] = al[j], al[i] }
 func (al apkPtrList) Less(i, j int) bool { return al[i].VersCode > al[j].VersCode }
 
+// removeCache removes the cache of the merged apps, which must be done
+// whenever the indexes or the repos in the config change.
+func removeCache() {
+	os.Remove(filepath.Join(mustCache(), "cache-gob"))
+}
+
 func loadIndexes() ([]fdroid.App, error) {
 	cachePath := filepath.Join(mustCache(), "cache-gob")
 	if f, err := os.Open(cachePath); err == nil {
-		defer f.Close()
 		var c cache
-		if err := gob.NewDecoder(f).Decode(&c); err == nil && c.Version == cacheVersion {
+		err := gob.NewDecoder(f).Decode(&c)
+		// Close it right away, as Windows won't replace an open file
+		// with a new cache.
+		f.Close()
+		if err == nil && c.Version == cacheVersion && samePins(c.PinnedRepos, config.PinnedRepos) {
 			return c.Apps, nil
 		}
 	}
+	state, err := readState()
+	if err != nil {
+		return nil, err
+	}
 	m := make(map[string]*fdroid.App)
+	var missing []string
+	loaded := 0
 	for _, r := range config.Repos {
 		if !r.Enabled {
 			continue
 		}
 		index, err := r.loadIndex()
-		if err != nil {
+		if err == errNoIndex {
+			// Perhaps the repo couldn't be updated; use the others.
+			missing = append(missing, r.ID)
+			continue
+		} else if err != nil {
 			return nil, fmt.Errorf("error while loading %s: %v", r.ID, err)
 		}
+		loaded++
+		st := state[r.ID]
+		mirrors := r.mirrors(&st, append([]string{index.Repo.Address}, index.Repo.Mirrors...)...)
 		for i := range index.Apps {
 			app := index.Apps[i]
 			app.FdroidRepoName = r.ID
 			app.FdroidRepoURL = r.URL
+			for _, apk := range app.Apks {
+				apk.RepoName = r.ID
+				apk.Mirrors = mirrors
+			}
+			pinned := config.PinnedRepos[app.PackageName]
+			app.PinnedRepo = pinned
 			orig, e := m[app.PackageName]
 			if !e {
 				m[app.PackageName] = &app
@@ -199,20 +722,40 @@ func loadIndexes() ([]fdroid.App, error) {
 			// (priority) is preserved amongst apks with the same
 			// vercode on apps
 			sort.Stable(apkPtrList(apks))
+			if pinned == r.ID {
+				// The details of the app, such as its
+				// suggested version, come from the pinned repo.
+				app.Apks = apks
+				m[app.PackageName] = &app
+				continue
+			}
 			m[app.PackageName].Apks = apks
 		}
 	}
+	if len(missing) > 0 {
+		if loaded == 0 {
+			return nil, fmt.Errorf("error while loading %s: %v", missing[0], errNoIndex)
+		}
+		fmt.Fprintf(os.Stderr, "warning: skipping repos without an index: %s\n", strings.Join(missing, ", "))
+	}
 	apps := make([]fdroid.App, 0, len(m))
 	for _, a := range m {
 		apps = append(apps, *a)
 	}
 	sort.Sort(fdroid.AppList(apps))
-	if f, err := os.Create(cachePath); err == nil {
-		defer f.Close()
-		gob.NewEncoder(f).Encode(cache{
-			Version: cacheVersion,
-			Apps:    apps,
+	// The cache is only an optimization, so failing to write it is not
+	// fatal. Don't cache an incomplete list of apps, though.
+	if len(missing) == 0 {
+		err := writeFileAtomic(cachePath, func(w io.Writer) error {
+			return gob.NewEncoder(w).Encode(cache{
+				Version:     cacheVersion,
+				PinnedRepos: config.PinnedRepos,
+				Apps:        apps,
+			})
 		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: could not write the cache: %v\n", err)
+		}
 	}
 	return apps, nil
 }